@@ -6,13 +6,20 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 
+	"github.com/carlos-nunez/go-api-template/deploy"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type API struct {
-	mdb mongo.Database
-	ctx context.Context
+	mdb          mongo.Database
+	ctx          context.Context
+	realtime     Realtime
+	webhooks     *webhookDispatcher
+	deployments  *deployQueue
+	provider     deploy.Provider
+	serverEvents *serverEventLog
 }
 
 func NewAPI() *API {
@@ -22,15 +29,32 @@ func NewAPI() *API {
 func (a *API) Initialize(db mongo.Database, context context.Context) {
 	a.mdb = db
 	a.ctx = context
+	a.webhooks = newWebhookDispatcher()
+	a.deployments = newDeployQueue()
+	a.serverEvents = newServerEventLog()
 }
 
-func (a *API) marshallBody(b interface{}, w http.ResponseWriter, r *http.Request) error {
+func (a *API) SetProvider(provider deploy.Provider) {
+	a.provider = provider
+}
+
+func (a *API) readBody(r *http.Request) ([]byte, error) {
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := r.Body.Close(); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+func (a *API) marshallBody(b interface{}, w http.ResponseWriter, r *http.Request) error {
+	body, err := a.readBody(r)
+
+	if err != nil {
 		return err
 	}
 	if err := json.Unmarshal(body, &b); err != nil {
@@ -39,3 +63,15 @@ func (a *API) marshallBody(b interface{}, w http.ResponseWriter, r *http.Request
 
 	return err
 }
+
+// backoff doubles the wait after every failed attempt, up to max.
+func backoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/carlos-nunez/go-api-template/services"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// Last used timestamps are only written this often, so busy keys don't
+	// cost a write per connection.
+	apiKeyTouchInterval    = time.Minute
+	defaultRotationOverlap = 24 * time.Hour
+	maxRotationOverlap     = 7 * 24 * time.Hour
+)
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type rotateRequest struct {
+	// How long the old key keeps working, so clients can move over.
+	OverlapSeconds *int `json:"overlap_seconds"`
+}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range model.ApiKeyScopes {
+			if scope == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%q is not a scope. Use connect, publish, tickets or admin.", scope)
+		}
+	}
+	return nil
+}
+
+// createApiKey saves a new key for a server and returns it with the key
+// itself, which can't be recovered later. Keys get the default scopes unless
+// given others.
+func (a API) createApiKey(serverUUID string, name string, scopes []string) (model.ApiKey, error) {
+	prefix, key, err := services.GenerateApiKey()
+	if err != nil {
+		return model.ApiKey{}, err
+	}
+	if len(scopes) == 0 {
+		scopes = model.DefaultApiKeyScopes
+	}
+
+	apiKey := model.ApiKey{
+		ServerUUID: serverUUID,
+		Name:       name,
+		Prefix:     prefix,
+		Hash:       services.HashApiKey(key),
+		Scopes:     scopes,
+		CreatedAt:  time.Now(),
+	}
+	result, err := a.mdb.Collection("api_keys").InsertOne(a.ctx, apiKey)
+	if err != nil {
+		return model.ApiKey{}, err
+	}
+
+	apiKey.ID = result.InsertedID.(primitive.ObjectID)
+	apiKey.Key = key
+	return apiKey, nil
+}
+
+// AuthenticateApiKey checks that key belongs to the server, hasn't been
+// revoked or expired, and has the scope.
+func (a API) AuthenticateApiKey(serverUUID string, key string, scope string) (model.ApiKey, error) {
+	var apiKey model.ApiKey
+	if key == "" {
+		return apiKey, errors.New("No token present!")
+	}
+
+	now := time.Now()
+	filter := bson.M{
+		"server_uuid": serverUUID,
+		"hash":        services.HashApiKey(key),
+		"revoked_at":  nil,
+		"$or":         bson.A{bson.M{"expires_at": nil}, bson.M{"expires_at": bson.M{"$gt": now}}},
+	}
+	if err := a.mdb.Collection("api_keys").FindOne(a.ctx, filter).Decode(&apiKey); err != nil {
+		return apiKey, errors.New("Authentication error!")
+	}
+
+	if !apiKey.HasScope(scope) {
+		return apiKey, fmt.Errorf("This key doesn't have the %s scope.", scope)
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		if _, err := a.mdb.Collection("api_keys").UpdateOne(a.ctx, bson.M{"_id": apiKey.ID}, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+			fmt.Println("Error updating API key last use:", err)
+		}
+	}
+	return apiKey, nil
+}
+
+// getServerByApiKey returns the server named in the route if the request
+// carries one of its API keys with the scope as a bearer token.
+func (a API) getServerByApiKey(r *http.Request, scope string) (model.WebsocketServer, error) {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		return model.WebsocketServer{}, errors.New("No token present!")
+	}
+
+	server, err := a.GetWSServerByUUID(mux.Vars(r)["uuid"])
+	if err != nil {
+		return model.WebsocketServer{}, errors.New("Server not found.")
+	}
+
+	if _, err = a.AuthenticateApiKey(server.UUID, key, scope); err != nil {
+		return model.WebsocketServer{}, err
+	}
+
+	return server, nil
+}
+
+// revokeApiKeys revokes every key of a server, when it is deleted.
+func (a API) revokeApiKeys(serverUUID string) error {
+	_, err := a.mdb.Collection("api_keys").UpdateMany(a.ctx, bson.M{"server_uuid": serverUUID, "revoked_at": nil}, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	return err
+}
+
+// MigrateApiTokens moves the plaintext tokens servers were created with
+// before API keys into hashed keys named "default".
+func (a API) MigrateApiTokens() {
+	var servers []model.WebsocketServer
+	cur, err := a.mdb.Collection("servers").Find(a.ctx, bson.M{"token": bson.M{"$nin": bson.A{nil, ""}}})
+	if err != nil {
+		fmt.Println("Error migrating API tokens:", err)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &servers); err != nil {
+		fmt.Println("Error migrating API tokens:", err)
+		return
+	}
+
+	for _, server := range servers {
+		// Legacy tokens have no prefix of their own, and the start of the
+		// token would give part of it away, so the start of its hash is used.
+		hash := services.HashApiKey(server.ApiToken)
+		apiKey := model.ApiKey{
+			ServerUUID: server.UUID,
+			Name:       "default",
+			Prefix:     hash[:8],
+			Hash:       hash,
+			Scopes:     model.DefaultApiKeyScopes,
+			CreatedAt:  time.Now(),
+		}
+		// A key from an earlier, interrupted run is already there.
+		_, err := a.mdb.Collection("api_keys").InsertOne(a.ctx, apiKey)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			fmt.Println("Error migrating API token of", server.UUID+":", err)
+			continue
+		}
+		// Servers that keep their token are migrated again on the next start.
+		_, err = a.mdb.Collection("servers").UpdateOne(a.ctx, bson.M{"_id": server.ID}, bson.M{"$unset": bson.M{"token": ""}})
+		if err != nil {
+			fmt.Println("Error removing API token of", server.UUID+":", err)
+		}
+	}
+	if len(servers) > 0 {
+		fmt.Println("Migrated API tokens of", len(servers), "servers.")
+	}
+}
+
+// FetchApiKeys lists the keys of a server, revoked ones included.
+func (a API) FetchApiKeys(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	keys := []model.ApiKey{}
+	cur, err := a.mdb.Collection("api_keys").Find(a.ctx, bson.M{"server_uuid": server.UUID})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &keys); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(keys)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) CreateApiKey(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getManagedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var request apiKeyRequest
+	if err = a.marshallBody(&request, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if request.Name == "" {
+		http.Error(w, "Please name the key.", 400)
+		return
+	}
+	if err = validateScopes(request.Scopes); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	apiKey, err := a.createApiKey(server.UUID, request.Name, request.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(apiKey)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// getActiveApiKey returns the key named in the route if it belongs to the
+// server and hasn't been revoked or expired.
+func (a API) getActiveApiKey(server model.WebsocketServer, r *http.Request) (model.ApiKey, error) {
+	var apiKey model.ApiKey
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return apiKey, errors.New("Key not found.")
+	}
+
+	filter := bson.M{
+		"_id":         id,
+		"server_uuid": server.UUID,
+		"revoked_at":  nil,
+		"$or":         bson.A{bson.M{"expires_at": nil}, bson.M{"expires_at": bson.M{"$gt": time.Now()}}},
+	}
+	if err = a.mdb.Collection("api_keys").FindOne(a.ctx, filter).Decode(&apiKey); err != nil {
+		return apiKey, errors.New("Key not found.")
+	}
+	return apiKey, nil
+}
+
+// RotateApiKey replaces a key with a new one with the same name and scopes.
+// The old key keeps working for the overlap, a day by default, so clients
+// can move over; an overlap of 0 revokes it right away.
+func (a API) RotateApiKey(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getManagedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	old, err := a.getActiveApiKey(server, r)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	var request rotateRequest
+	if body, _ := a.readBody(r); len(body) > 0 {
+		if err = json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	overlap := defaultRotationOverlap
+	if request.OverlapSeconds != nil {
+		overlap = time.Duration(*request.OverlapSeconds) * time.Second
+		if overlap < 0 || overlap > maxRotationOverlap {
+			http.Error(w, "overlap_seconds must be between 0 and 604800.", 400)
+			return
+		}
+	}
+
+	apiKey, err := a.createApiKey(server.UUID, old.Name, old.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// A key rotated twice keeps the earlier of its expiries.
+	expires := time.Now().Add(overlap)
+	if old.ExpiresAt != nil && old.ExpiresAt.Before(expires) {
+		expires = *old.ExpiresAt
+	}
+	_, err = a.mdb.Collection("api_keys").UpdateOne(a.ctx, bson.M{"_id": old.ID}, bson.M{"$set": bson.M{"expires_at": expires}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(apiKey)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// RevokeApiKey stops a key from working right away. Revoked keys stay
+// listed.
+func (a API) RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getManagedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	apiKey, err := a.getActiveApiKey(server, r)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	now := time.Now()
+	_, err = a.mdb.Collection("api_keys").UpdateOne(a.ctx, bson.M{"_id": apiKey.ID}, bson.M{"$set": bson.M{"revoked_at": now}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	apiKey.RevokedAt = &now
+
+	js, _ := json.Marshal(apiKey)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
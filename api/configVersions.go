@@ -0,0 +1,277 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/deploy"
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultConfigVersions = 20
+	maxConfigVersions     = 100
+)
+
+// errConfigConflict is returned when the config of a server changed while a
+// new version was being saved.
+var errConfigConflict = errors.New("The configuration was changed in the meantime. Fetch it and try again.")
+
+// configUpdate is a new configuration for a server. Version is the version
+// it was based on, if the client wants to be sure nobody changed it since.
+type configUpdate struct {
+	Version *int                `json:"version"`
+	Config  *model.ServerConfig `json:"config"`
+}
+
+// recordConfigVersion adds the current config of a server to its history.
+func (a API) recordConfigVersion(server model.WebsocketServer, email string) error {
+	version := model.ServerConfigVersion{
+		ServerUUID: server.UUID,
+		Version:    server.ConfigVersion,
+		Config:     server.Config,
+		UpdatedBy:  email,
+		CreatedAt:  time.Now(),
+	}
+	_, err := a.mdb.Collection("server_configs").InsertOne(a.ctx, version)
+	return err
+}
+
+// saveServerConfig stores config as the next version of the server's
+// configuration and pushes it to the server's connections. It fails with
+// errConfigConflict if the config changed since server was read.
+func (a API) saveServerConfig(server model.WebsocketServer, config model.ServerConfig, email string) (model.WebsocketServer, error) {
+	filter := bson.M{"uuid": server.UUID, "config_version": server.ConfigVersion}
+	if server.ConfigVersion == 0 {
+		// Servers from before versioning have no config_version.
+		filter["config_version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	update := bson.M{
+		"$set": bson.M{"config": config, "updated_at": time.Now()},
+		"$inc": bson.M{"config_version": 1},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var saved model.WebsocketServer
+	err := a.mdb.Collection("servers").FindOneAndUpdate(a.ctx, filter, update, opts).Decode(&saved)
+	if err == mongo.ErrNoDocuments {
+		return saved, errConfigConflict
+	}
+	if err != nil {
+		return saved, err
+	}
+
+	if err = a.recordConfigVersion(saved, email); err != nil {
+		fmt.Println("Error recording config version:", err)
+	}
+	a.pushServerConfig(saved)
+	return saved, nil
+}
+
+// pushServerConfig applies the config of a server to its open connections:
+// those on this process right away, and those on its deployed instances
+// through the deployment provider.
+func (a API) pushServerConfig(server model.WebsocketServer) {
+	if a.realtime != nil {
+		a.realtime.ApplyConfig(server)
+	}
+	if server.Status != model.ServerRunning && server.Status != model.ServerUpdating {
+		return
+	}
+
+	go func() {
+		// Instances that can't be reached pick the config up as clients
+		// reconnect.
+		err := a.provider.Configure(server)
+		if err != nil && err != deploy.ErrNotSupported && err != deploy.ErrNotFound {
+			fmt.Println("Error pushing config of", server.UUID+":", err)
+		}
+	}()
+}
+
+// checkServerConfig validates a config for a server, against its plan if it
+// has one.
+func checkServerConfig(server model.WebsocketServer, config model.ServerConfig) error {
+	if err := validateServerConfig(config); err != nil {
+		return err
+	}
+	// Servers from before plans keep running without one until one is
+	// chosen.
+	if server.Plan == "" {
+		return nil
+	}
+	server.Config = config
+	return applyPlan(&server)
+}
+
+func writeConfigVersion(w http.ResponseWriter, server model.WebsocketServer, email string) {
+	version := model.ServerConfigVersion{
+		ServerUUID: server.UUID,
+		Version:    server.ConfigVersion,
+		Config:     server.Config,
+		UpdatedBy:  email,
+		CreatedAt:  server.UpdatedAt,
+	}
+	js, _ := json.Marshal(version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// FetchServerConfig returns the current config of a server and its version.
+func (a API) FetchServerConfig(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var version model.ServerConfigVersion
+	filter := bson.M{"server_uuid": server.UUID, "version": server.ConfigVersion}
+	if err = a.mdb.Collection("server_configs").FindOne(a.ctx, filter).Decode(&version); err != nil {
+		// Configs from before versioning have no history.
+		writeConfigVersion(w, server, "")
+		return
+	}
+
+	js, _ := json.Marshal(version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// UpdateServerConfig replaces the config of a server with a new version,
+// which running instances apply to their open connections.
+func (a API) UpdateServerConfig(w http.ResponseWriter, r *http.Request) {
+	user, server, err := a.getRouteServer(w, r)
+	if err == nil && !a.managesServer(user, server) {
+		err = errors.New("Only owners and admins of the server can do this.")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if server.DesiredState == model.DesiredDeleted {
+		http.Error(w, "Server is being deleted.", http.StatusConflict)
+		return
+	}
+
+	var update configUpdate
+	if err = a.marshallBody(&update, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if update.Config == nil {
+		http.Error(w, "Please send a config.", 400)
+		return
+	}
+	if update.Version != nil && *update.Version != server.ConfigVersion {
+		http.Error(w, errConfigConflict.Error(), http.StatusConflict)
+		return
+	}
+	if err = checkServerConfig(server, *update.Config); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	server, err = a.saveServerConfig(server, *update.Config, user.Email)
+	if err == errConfigConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	writeConfigVersion(w, server, user.Email)
+}
+
+// FetchServerConfigVersions lists the latest versions of a server's config,
+// newest first.
+func (a API) FetchServerConfigVersions(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	limit := defaultConfigVersions
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxConfigVersions {
+			http.Error(w, "limit must be between 1 and 100.", 400)
+			return
+		}
+	}
+
+	versions := []model.ServerConfigVersion{}
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: -1}}).SetLimit(int64(limit))
+	cur, err := a.mdb.Collection("server_configs").Find(a.ctx, bson.M{"server_uuid": server.UUID}, opts)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &versions); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(versions)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// RestoreServerConfig saves an earlier version of a server's config as its
+// newest version.
+func (a API) RestoreServerConfig(w http.ResponseWriter, r *http.Request) {
+	user, server, err := a.getRouteServer(w, r)
+	if err == nil && !a.managesServer(user, server) {
+		err = errors.New("Only owners and admins of the server can do this.")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if server.DesiredState == model.DesiredDeleted {
+		http.Error(w, "Server is being deleted.", http.StatusConflict)
+		return
+	}
+
+	number, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		http.Error(w, "Version not found.", 404)
+		return
+	}
+	var version model.ServerConfigVersion
+	filter := bson.M{"server_uuid": server.UUID, "version": number}
+	if err = a.mdb.Collection("server_configs").FindOne(a.ctx, filter).Decode(&version); err != nil {
+		http.Error(w, "Version not found.", 404)
+		return
+	}
+
+	// The plan may have changed since.
+	if err = checkServerConfig(server, version.Config); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	server, err = a.saveServerConfig(server, version.Config, user.Email)
+	if err == errConfigConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	writeConfigVersion(w, server, user.Email)
+}
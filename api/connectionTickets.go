@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/carlos-nunez/go-api-template/services"
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultTicketTTL = 60 * time.Second
+	maxTicketTTL     = 5 * time.Minute
+)
+
+type connectionTicketRequest struct {
+	User       string             `json:"user"`
+	Rooms      []model.TicketRoom `json:"rooms"`
+	TTLSeconds int                `json:"ttl_seconds"`
+}
+
+type connectionTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// redeemedTicket records a ticket that has been used. Records expire with
+// the ticket, after which it is rejected anyway.
+type redeemedTicket struct {
+	ID        string    `bson:"_id"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// CreateConnectionTicket mints a short-lived ticket a client can use to
+// connect to the server instead of its API token.
+func (a API) CreateConnectionTicket(w http.ResponseWriter, r *http.Request) {
+	server, user, err := a.getTicketIssuer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var request connectionTicketRequest
+	err = a.marshallBody(&request, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if user != "" {
+		request.User = user
+	}
+
+	if len(request.Rooms) == 0 {
+		http.Error(w, "A ticket needs at least one room.", 400)
+		return
+	}
+	for _, room := range request.Rooms {
+		if room.Room == "" || (!room.Publish && !room.Subscribe) {
+			http.Error(w, "Every room needs a name and publish or subscribe access.", 400)
+			return
+		}
+	}
+
+	ttl := defaultTicketTTL
+	if request.TTLSeconds > 0 {
+		ttl = time.Duration(request.TTLSeconds) * time.Second
+	}
+	if ttl > maxTicketTTL {
+		http.Error(w, "ttl_seconds can be at most 300.", 400)
+		return
+	}
+
+	id, err := services.GenerateWSToken(24)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	ticket, err := services.GenerateConnectionTicket(model.ConnectionTicketClaims{
+		User:   request.User,
+		Server: server.UUID,
+		Rooms:  request.Rooms,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(connectionTicketResponse{Ticket: ticket, ExpiresAt: expiresAt})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// getTicketIssuer authenticates a request for a ticket. Servers need an API
+// key with the tickets scope. On the user server, users mint tickets for
+// themselves with their login token, and their email is returned as well.
+func (a API) getTicketIssuer(w http.ResponseWriter, r *http.Request) (model.WebsocketServer, string, error) {
+	if mux.Vars(r)["uuid"] != userServerUUID {
+		server, err := a.getServerByApiKey(r, model.ScopeTickets)
+		return server, "", err
+	}
+
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		return model.WebsocketServer{}, "", errors.New("Invalid token.")
+	}
+	return model.WebsocketServer{UUID: userServerUUID}, user.Email, nil
+}
+
+// RedeemConnectionTicket marks a ticket as used. It fails if the ticket has
+// been redeemed before.
+func (a API) RedeemConnectionTicket(claims *model.ConnectionTicketClaims) error {
+	_, err := a.mdb.Collection("redeemed_tickets").InsertOne(a.ctx, redeemedTicket{
+		ID:        claims.Id,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return errors.New("Ticket has already been used.")
+	}
+
+	return err
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Callbacks signed longer ago than this are rejected as replays.
+const callbackMaxAge = 5 * time.Minute
+
+// deployCallback is what the deploy service reports about a server.
+type deployCallback struct {
+	UUID     string `json:"uuid"`
+	Status   string `json:"status"`
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Error    string `json:"error"`
+}
+
+var callbackStatuses = []string{
+	model.ServerProvisioning,
+	model.ServerRunning,
+	model.ServerUpdating,
+	model.ServerSuspended,
+	model.ServerFailed,
+	model.ServerDeleting,
+	model.ServerDeleted,
+}
+
+// verifyDeployCallback checks that a callback was signed with DEPLOY_KEY
+// recently.
+func verifyDeployCallback(r *http.Request, body []byte) bool {
+	if DEPLOY_KEY == "" {
+		return false
+	}
+
+	timestamp := r.Header.Get("X-Deploy-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > callbackMaxAge || age < -callbackMaxAge {
+		return false
+	}
+
+	expected := signPayload(DEPLOY_KEY, timestamp, body)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(r.Header.Get("X-Deploy-Signature"))) == 1
+}
+
+// DeploymentCallback lets the deploy service report that a server finished
+// provisioning, crashed or was torn down.
+func (a API) DeploymentCallback(w http.ResponseWriter, r *http.Request) {
+	body, err := a.readBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if !verifyDeployCallback(r, body) {
+		http.Error(w, "Invalid signature.", http.StatusUnauthorized)
+		return
+	}
+
+	var callback deployCallback
+	if err = json.Unmarshal(body, &callback); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	known := false
+	for _, status := range callbackStatuses {
+		if callback.Status == status {
+			known = true
+			break
+		}
+	}
+	if !known {
+		http.Error(w, "Unknown status "+callback.Status+".", 400)
+		return
+	}
+
+	var server model.WebsocketServer
+	err = a.mdb.Collection("servers").FindOne(a.ctx, bson.D{{Key: "uuid", Value: callback.UUID}}).Decode(&server)
+	if err != nil {
+		http.Error(w, "Server not found.", 404)
+		return
+	}
+	if server.Status == model.ServerDeleted {
+		http.Error(w, "Server was deleted.", http.StatusConflict)
+		return
+	}
+
+	set := bson.M{"status": callback.Status, "error": callback.Error}
+	if callback.Endpoint != "" {
+		set["endpoint"] = callback.Endpoint
+	}
+	if callback.Region != "" {
+		set["region"] = callback.Region
+	}
+	server, err = a.updateServerStatus(server.UUID, set)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	server.ApiToken = ""
+	js, _ := json.Marshal(server)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
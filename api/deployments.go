@@ -0,0 +1,436 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/deploy"
+	"github.com/carlos-nunez/go-api-template/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	deployPollInterval = 5 * time.Second
+	// A claimed job is picked up again if it isn't settled within the
+	// lease, e.g. because the process died mid-request.
+	deployLease         = 2 * time.Minute
+	deployMaxAttempts   = 6
+	deployBaseBackoff   = 10 * time.Second
+	deployMaxBackoff    = 10 * time.Minute
+	reconcileInterval   = time.Minute
+	pendingTimeout      = time.Minute
+	provisioningTimeout = 15 * time.Minute
+	// Deletions that ran out of attempts are tried again after this,
+	// doubling with every failed try.
+	destroyRetryBaseBackoff = 5 * time.Minute
+	destroyRetryMaxBackoff  = 6 * time.Hour
+)
+
+// legacyCreating is the status servers were created with before deployments
+// were tracked. The reconciler deploys them like pending servers.
+const legacyCreating = "Creating..."
+
+// deployQueue wakes the deploy worker when a job is queued.
+type deployQueue struct {
+	wake chan struct{}
+}
+
+func newDeployQueue() *deployQueue {
+	return &deployQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *deployQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueDeployJob queues an action for a server, canceling whatever job the
+// server had queued before.
+func (a API) enqueueDeployJob(serverUUID string, action string) error {
+	now := time.Now()
+	jobs := a.mdb.Collection("deploy_jobs")
+
+	cancel := bson.M{"$set": bson.M{"active": false, "status": model.JobCanceled, "updated_at": now}}
+	if _, err := jobs.UpdateMany(a.ctx, bson.M{"server_uuid": serverUUID, "active": true}, cancel); err != nil {
+		return err
+	}
+
+	_, err := jobs.InsertOne(a.ctx, model.DeployJob{
+		ServerUUID:    serverUUID,
+		Action:        action,
+		Status:        model.JobPending,
+		Active:        true,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.deployments.notify()
+	return nil
+}
+
+type serverStatusNotice struct {
+	Type     string `json:"type"`
+	Server   string `json:"server"`
+	Status   string `json:"status"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// setServerStatus records where a server is in its deployment.
+func (a API) setServerStatus(serverUUID string, status string, reason string) {
+	a.updateServerStatus(serverUUID, bson.M{"status": status, "error": reason})
+}
+
+// updateServerStatus sets deployment fields of a server and tells its
+// members about the change.
+func (a API) updateServerStatus(serverUUID string, set bson.M) (model.WebsocketServer, error) {
+	set["updated_at"] = time.Now()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var server model.WebsocketServer
+	err := a.mdb.Collection("servers").FindOneAndUpdate(a.ctx, bson.D{{Key: "uuid", Value: serverUUID}}, bson.M{"$set": set}, opts).Decode(&server)
+	if err != nil {
+		fmt.Println("Error updating server status:", err)
+		return server, err
+	}
+
+	a.notifyServerMembers(server, serverStatusNotice{
+		Type:     "server.status",
+		Server:   server.UUID,
+		Status:   server.Status,
+		Endpoint: server.Endpoint,
+		Region:   server.Region,
+		Error:    server.Error,
+	})
+	if status, ok := set["status"].(string); ok {
+		event := model.ServerEvent{Type: model.ServerEventDeploy, Message: "Server is " + status + "."}
+		if server.Error != "" {
+			event.Message += " " + server.Error
+		}
+		if status == model.ServerFailed {
+			event.Level = model.EventLevelError
+		}
+		a.LogServerEvent(server, event)
+	}
+	return server, nil
+}
+
+// RunDeployments works through deploy jobs and reconciles servers with
+// their desired state until ctx is done.
+func (a API) RunDeployments(ctx context.Context) {
+	ticker := time.NewTicker(deployPollInterval)
+	defer ticker.Stop()
+	reconcile := time.NewTicker(reconcileInterval)
+	defer reconcile.Stop()
+
+	a.reconcileServers()
+	for {
+		a.runDueJobs(ctx)
+		select {
+		case <-a.deployments.wake:
+		case <-ticker.C:
+		case <-reconcile.C:
+			a.reconcileServers()
+		case <-ctx.Done():
+			if stopper, ok := a.provider.(deploy.Stopper); ok {
+				stopper.Stop()
+			}
+			return
+		}
+	}
+}
+
+func (a API) runDueJobs(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := a.claimDeployJob()
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				fmt.Println("Error claiming deploy job:", err)
+			}
+			return
+		}
+		a.runDeployJob(job)
+	}
+}
+
+// claimDeployJob leases the next due job so no other worker, in this process
+// or another, runs it at the same time.
+func (a API) claimDeployJob() (model.DeployJob, error) {
+	now := time.Now()
+	filter := bson.M{"active": true, "next_attempt_at": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"status": model.JobRunning, "next_attempt_at": now.Add(deployLease), "updated_at": now}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).SetReturnDocument(options.After)
+
+	var job model.DeployJob
+	err := a.mdb.Collection("deploy_jobs").FindOneAndUpdate(a.ctx, filter, update, opts).Decode(&job)
+	return job, err
+}
+
+func (a API) runDeployJob(job model.DeployJob) {
+	var server model.WebsocketServer
+	err := a.mdb.Collection("servers").FindOne(a.ctx, bson.D{{Key: "uuid", Value: job.ServerUUID}}).Decode(&server)
+	if err != nil {
+		a.settleDeployJob(job, bson.M{"status": model.JobFailed, "error": "Server not found."})
+		return
+	}
+
+	inProgress := model.ServerProvisioning
+	send := a.provider.Create
+	switch job.Action {
+	case model.DeployActionDestroy:
+		inProgress = model.ServerDeleting
+		send = a.provider.Destroy
+	case model.DeployActionScale:
+		inProgress = model.ServerUpdating
+		replicas := server.Instances()
+		if server.DesiredState == model.DesiredSuspended {
+			replicas = 0
+		}
+		send = func(server model.WebsocketServer) (deploy.Status, error) {
+			return a.provider.Scale(server, replicas)
+		}
+	}
+	a.setServerStatus(server.UUID, inProgress, server.Error)
+
+	// Providers that finish in the background leave the server in
+	// progress and report back through the deployment callback.
+	status, err := send(server)
+	attempts := job.Attempts + 1
+	switch {
+	case err == nil:
+		if a.settleDeployJob(job, bson.M{"status": model.JobSucceeded, "attempts": attempts, "error": ""}) {
+			if status.State == model.ServerRunning && server.DesiredState == model.DesiredSuspended {
+				status.State = model.ServerSuspended
+			}
+			a.applyProviderStatus(server.UUID, status)
+		}
+	case attempts >= deployMaxAttempts:
+		if a.settleDeployJob(job, bson.M{"status": model.JobFailed, "attempts": attempts, "error": err.Error()}) {
+			a.setServerStatus(server.UUID, model.ServerFailed, err.Error())
+		}
+	default:
+		retry := bson.M{
+			"status":          model.JobPending,
+			"active":          true,
+			"attempts":        attempts,
+			"error":           err.Error(),
+			"next_attempt_at": time.Now().Add(backoff(attempts, deployBaseBackoff, deployMaxBackoff)),
+		}
+		if a.settleDeployJob(job, retry) {
+			a.setServerStatus(server.UUID, inProgress, err.Error())
+		}
+	}
+}
+
+// settleDeployJob records the outcome of a job. It reports false if the job
+// was canceled in the meantime, in which case the server is left to the job
+// that replaced it.
+func (a API) settleDeployJob(job model.DeployJob, set bson.M) bool {
+	if _, ok := set["active"]; !ok {
+		set["active"] = false
+	}
+	set["updated_at"] = time.Now()
+
+	result, err := a.mdb.Collection("deploy_jobs").UpdateOne(a.ctx, bson.M{"_id": job.ID, "active": true}, bson.M{"$set": set})
+	if err != nil {
+		fmt.Println("Error updating deploy job:", err)
+		return false
+	}
+	return result.MatchedCount > 0
+}
+
+// applyProviderStatus records what the provider says about a server.
+func (a API) applyProviderStatus(serverUUID string, status deploy.Status) {
+	set := bson.M{"status": status.State, "error": status.Error}
+	if status.Endpoint != "" {
+		set["endpoint"] = status.Endpoint
+	}
+	if status.Region != "" {
+		set["region"] = status.Region
+	}
+	a.updateServerStatus(serverUUID, set)
+}
+
+// destroyRetryDue reports whether a server whose deletion failed has waited
+// long enough to be tried again, backing off with every failed destroy job.
+func (a API) destroyRetryDue(server model.WebsocketServer, now time.Time) bool {
+	filter := bson.M{"server_uuid": server.UUID, "action": model.DeployActionDestroy, "status": model.JobFailed}
+	failures, err := a.mdb.Collection("deploy_jobs").CountDocuments(a.ctx, filter)
+	if err != nil {
+		fmt.Println("Error counting failed deploy jobs:", err)
+		return false
+	}
+	wait := backoff(int(failures), destroyRetryBaseBackoff, destroyRetryMaxBackoff)
+	return server.UpdatedAt.Add(wait).Before(now)
+}
+
+func (a API) hasActiveDeployJob(serverUUID string) bool {
+	count, err := a.mdb.Collection("deploy_jobs").CountDocuments(a.ctx, bson.M{"server_uuid": serverUUID, "active": true})
+	// Assume there is one if we can't tell, rather than queueing another.
+	return err != nil || count > 0
+}
+
+// reconcileServers queues jobs for servers that are not where they should
+// be and have nothing queued to get them there: servers that were never
+// deployed, deployments, updates or deletions the deploy service never
+// reported finished, and deletions that failed, so their resources don't
+// leak.
+func (a API) reconcileServers() {
+	now := time.Now()
+	filter := bson.M{"$or": bson.A{
+		bson.M{
+			"desired_state": bson.M{"$ne": model.DesiredDeleted},
+			"status":        model.ServerPending,
+			"updated_at":    bson.M{"$lt": now.Add(-pendingTimeout)},
+		},
+		bson.M{"status": legacyCreating},
+		bson.M{
+			"desired_state": bson.M{"$ne": model.DesiredDeleted},
+			"status":        model.ServerProvisioning,
+			"updated_at":    bson.M{"$lt": now.Add(-provisioningTimeout)},
+		},
+		bson.M{
+			"desired_state": bson.M{"$ne": model.DesiredDeleted},
+			"status":        model.ServerUpdating,
+			"updated_at":    bson.M{"$lt": now.Add(-provisioningTimeout)},
+		},
+		bson.M{
+			"desired_state": model.DesiredDeleted,
+			"status":        bson.M{"$nin": bson.A{model.ServerDeleted, model.ServerFailed}},
+			"updated_at":    bson.M{"$lt": now.Add(-provisioningTimeout)},
+		},
+		bson.M{
+			"desired_state": model.DesiredDeleted,
+			"status":        model.ServerFailed,
+			"updated_at":    bson.M{"$lt": now.Add(-destroyRetryBaseBackoff)},
+		},
+	}}
+
+	var servers []model.WebsocketServer
+	cur, err := a.mdb.Collection("servers").Find(a.ctx, filter)
+	if err != nil {
+		fmt.Println("Error reconciling servers:", err)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &servers); err != nil {
+		fmt.Println("Error reconciling servers:", err)
+		return
+	}
+
+	for _, server := range servers {
+		if a.hasActiveDeployJob(server.UUID) {
+			continue
+		}
+		if server.DesiredState == model.DesiredDeleted && server.Status == model.ServerFailed && !a.destroyRetryDue(server, now) {
+			continue
+		}
+
+		action := model.DeployActionDeploy
+		if server.DesiredState == model.DesiredDeleted {
+			action = model.DeployActionDestroy
+		} else if server.Status == model.ServerUpdating {
+			action = model.DeployActionScale
+		}
+		fmt.Println("Reconciling server", server.UUID+":", action)
+		if err := a.enqueueDeployJob(server.UUID, action); err != nil {
+			fmt.Println("Error queueing deploy job:", err)
+		}
+	}
+
+	a.checkRunningServers()
+}
+
+// checkRunningServers asks the provider about servers that should be
+// running, and deploys those it has lost again.
+func (a API) checkRunningServers() {
+	var servers []model.WebsocketServer
+	filter := bson.M{"desired_state": bson.M{"$ne": model.DesiredDeleted}, "status": model.ServerRunning}
+	cur, err := a.mdb.Collection("servers").Find(a.ctx, filter)
+	if err != nil {
+		fmt.Println("Error reconciling servers:", err)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &servers); err != nil {
+		fmt.Println("Error reconciling servers:", err)
+		return
+	}
+
+	for _, server := range servers {
+		status, err := a.provider.Status(server)
+		switch {
+		case err == deploy.ErrNotSupported:
+			return
+		case err == deploy.ErrNotFound:
+			status = deploy.Status{State: model.ServerFailed, Error: "The deployment provider isn't running the server."}
+		case err != nil:
+			fmt.Println("Error checking server", server.UUID+":", err)
+			continue
+		}
+		if status.State != model.ServerFailed || a.hasActiveDeployJob(server.UUID) {
+			continue
+		}
+
+		fmt.Println("Reconciling server", server.UUID+": deploy")
+		a.applyProviderStatus(server.UUID, status)
+		if err := a.enqueueDeployJob(server.UUID, model.DeployActionDeploy); err != nil {
+			fmt.Println("Error queueing deploy job:", err)
+		}
+	}
+}
+
+const (
+	defaultLogLines = 100
+	maxLogLines     = 1000
+)
+
+// FetchServerLogs returns the latest output of a server, as far as the
+// deployment provider keeps it. Ask for up to 1000 lines with ?lines=.
+func (a API) FetchServerLogs(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	lines := defaultLogLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		lines, err = strconv.Atoi(value)
+		if err != nil || lines < 1 || lines > maxLogLines {
+			http.Error(w, "lines must be between 1 and 1000.", 400)
+			return
+		}
+	}
+
+	logs, err := a.provider.Logs(server, lines)
+	if err == deploy.ErrNotSupported {
+		http.Error(w, "The deployment provider doesn't keep logs.", http.StatusNotImplemented)
+		return
+	}
+	if err == deploy.ErrNotFound {
+		http.Error(w, "The server isn't running.", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(logs)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,507 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+type organizationRequest struct {
+	Name string `json:"name"`
+}
+
+type invitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type memberRequest struct {
+	Role string `json:"role"`
+}
+
+func validOrgRole(role string) bool {
+	return role == model.OrgRoleOwner || role == model.OrgRoleAdmin || role == model.OrgRoleMember
+}
+
+// canManage reports whether a role may manage servers and invite people.
+func canManage(role string) bool {
+	return role == model.OrgRoleOwner || role == model.OrgRoleAdmin
+}
+
+// orgRole returns the role of a user in an organization, or "" if they
+// aren't a member.
+func orgRole(org model.Organization, email string) string {
+	for _, member := range org.Members {
+		if member.Email == email {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+func countOwners(org model.Organization) int {
+	owners := 0
+	for _, member := range org.Members {
+		if member.Role == model.OrgRoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+func (a API) findOrg(id primitive.ObjectID) (model.Organization, error) {
+	var org model.Organization
+	err := a.mdb.Collection("organizations").FindOne(a.ctx, bson.D{{Key: "_id", Value: id}}).Decode(&org)
+	return org, err
+}
+
+// userOrgIDs returns the organizations a user is a member of.
+func (a API) userOrgIDs(email string) ([]primitive.ObjectID, error) {
+	ids := []primitive.ObjectID{}
+	orgs, err := a.userOrgs(email)
+	for _, org := range orgs {
+		ids = append(ids, org.ID)
+	}
+	return ids, err
+}
+
+func (a API) userOrgs(email string) ([]model.Organization, error) {
+	orgs := []model.Organization{}
+	cur, err := a.mdb.Collection("organizations").Find(a.ctx, bson.D{{Key: "members.email", Value: email}})
+	if err != nil {
+		return orgs, err
+	}
+	defer cur.Close(a.ctx)
+	err = cur.All(a.ctx, &orgs)
+	return orgs, err
+}
+
+// OrgPeers returns the users who share an organization with a user, who may
+// message each other on the user server.
+func (a API) OrgPeers(email string) (map[string]bool, error) {
+	peers := make(map[string]bool)
+	orgs, err := a.userOrgs(email)
+	for _, org := range orgs {
+		for _, member := range org.Members {
+			if member.Email != email {
+				peers[member.Email] = true
+			}
+		}
+	}
+	return peers, err
+}
+
+// getMemberOrg returns the organization named in the route, the user making
+// the request and their role, if they are a member.
+func (a API) getMemberOrg(w http.ResponseWriter, r *http.Request) (model.User, model.Organization, string, error) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		return user, model.Organization{}, "", errors.New("User not found.")
+	}
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return user, model.Organization{}, "", errors.New("Organization not found.")
+	}
+	org, err := a.findOrg(id)
+	if err != nil {
+		return user, org, "", errors.New("Organization not found.")
+	}
+
+	role := orgRole(org, user.Email)
+	if role == "" {
+		return user, org, "", errors.New("Not a member of this organization.")
+	}
+	return user, org, role, nil
+}
+
+// notifyServerMembers tells everyone with access to a server about it: the
+// members of its organization, or its creator.
+func (a API) notifyServerMembers(server model.WebsocketServer, payload interface{}) {
+	if server.OrgID == nil {
+		a.notifyUser(server.UserEmail, payload)
+		return
+	}
+	org, err := a.findOrg(*server.OrgID)
+	if err != nil {
+		return
+	}
+	for _, member := range org.Members {
+		a.notifyUser(member.Email, payload)
+	}
+}
+
+func (a API) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusForbidden)
+		return
+	}
+
+	var request organizationRequest
+	if err = a.marshallBody(&request, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if request.Name == "" {
+		http.Error(w, "Please name the organization.", 400)
+		return
+	}
+
+	now := time.Now()
+	org := model.Organization{
+		Name:      request.Name,
+		Members:   []model.OrgMember{{Email: user.Email, Role: model.OrgRoleOwner, JoinedAt: now}},
+		CreatedAt: now,
+	}
+	result, err := a.mdb.Collection("organizations").InsertOne(a.ctx, org)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	org.ID = result.InsertedID.(primitive.ObjectID)
+
+	js, _ := json.Marshal(org)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// FetchOrganizations lists the organizations of the current user.
+func (a API) FetchOrganizations(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusForbidden)
+		return
+	}
+
+	orgs, err := a.userOrgs(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(orgs)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) FetchOrganization(w http.ResponseWriter, r *http.Request) {
+	_, org, _, err := a.getMemberOrg(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	js, _ := json.Marshal(org)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// DeleteOrganization deletes an organization that no longer has servers.
+// Only owners can delete it.
+func (a API) DeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	_, org, role, err := a.getMemberOrg(w, r)
+	if err != nil || role != model.OrgRoleOwner {
+		http.Error(w, "Only owners can delete an organization.", http.StatusForbidden)
+		return
+	}
+
+	count, err := a.mdb.Collection("servers").CountDocuments(a.ctx, bson.M{"org_id": org.ID, "status": bson.M{"$ne": model.ServerDeleted}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Delete or transfer the organization's servers first.", http.StatusConflict)
+		return
+	}
+
+	if _, err = a.mdb.Collection("organizations").DeleteOne(a.ctx, bson.D{{Key: "_id", Value: org.ID}}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	a.mdb.Collection("org_invitations").DeleteMany(a.ctx, bson.D{{Key: "org_id", Value: org.ID}})
+
+	js, _ := json.Marshal(org)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// FetchOrganizationQuota returns the quota of an organization and how much
+// of it its servers use.
+func (a API) FetchOrganizationQuota(w http.ResponseWriter, r *http.Request) {
+	_, org, _, err := a.getMemberOrg(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	usage, err := a.ownerUsage("", &org.ID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(usage)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// InviteMember invites someone to an organization by email. Owners and
+// admins can invite; only owners can invite owners. Inviting the same email
+// again replaces the invitation.
+func (a API) InviteMember(w http.ResponseWriter, r *http.Request) {
+	user, org, role, err := a.getMemberOrg(w, r)
+	if err != nil || !canManage(role) {
+		http.Error(w, "Only owners and admins can invite people.", http.StatusForbidden)
+		return
+	}
+
+	var request invitationRequest
+	if err = a.marshallBody(&request, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if request.Email == "" {
+		http.Error(w, "Please enter an email.", 400)
+		return
+	}
+	if request.Role == "" {
+		request.Role = model.OrgRoleMember
+	}
+	if !validOrgRole(request.Role) {
+		http.Error(w, "Role must be owner, admin or member.", 400)
+		return
+	}
+	if request.Role == model.OrgRoleOwner && role != model.OrgRoleOwner {
+		http.Error(w, "Only owners can invite owners.", http.StatusForbidden)
+		return
+	}
+	if orgRole(org, request.Email) != "" {
+		http.Error(w, "Already a member of this organization.", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	invitation := model.OrgInvitation{
+		OrgID:     org.ID,
+		OrgName:   org.Name,
+		Email:     request.Email,
+		Role:      request.Role,
+		InvitedBy: user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(invitationTTL),
+	}
+	filter := bson.M{"org_id": org.ID, "email": request.Email}
+	opts := options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.After)
+	err = a.mdb.Collection("org_invitations").FindOneAndReplace(a.ctx, filter, invitation, opts).Decode(&invitation)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	a.notifyUser(invitation.Email, map[string]interface{}{
+		"type":       "org.invitation",
+		"invitation": invitation,
+	})
+
+	js, _ := json.Marshal(invitation)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// FetchOrganizationInvitations lists the pending invitations of an
+// organization.
+func (a API) FetchOrganizationInvitations(w http.ResponseWriter, r *http.Request) {
+	_, org, role, err := a.getMemberOrg(w, r)
+	if err != nil || !canManage(role) {
+		http.Error(w, "Only owners and admins can see invitations.", http.StatusForbidden)
+		return
+	}
+
+	a.writeInvitations(w, bson.M{"org_id": org.ID, "expires_at": bson.M{"$gt": time.Now()}})
+}
+
+func (a API) DeleteInvitation(w http.ResponseWriter, r *http.Request) {
+	_, org, role, err := a.getMemberOrg(w, r)
+	if err != nil || !canManage(role) {
+		http.Error(w, "Only owners and admins can withdraw invitations.", http.StatusForbidden)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["invitation"])
+	if err != nil {
+		http.Error(w, "Invitation not found.", 404)
+		return
+	}
+	result, err := a.mdb.Collection("org_invitations").DeleteOne(a.ctx, bson.M{"_id": id, "org_id": org.ID})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Invitation not found.", 404)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// FetchInvitations lists the pending invitations of the current user.
+func (a API) FetchInvitations(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusForbidden)
+		return
+	}
+
+	a.writeInvitations(w, bson.M{"email": user.Email, "expires_at": bson.M{"$gt": time.Now()}})
+}
+
+func (a API) writeInvitations(w http.ResponseWriter, filter bson.M) {
+	invitations := []model.OrgInvitation{}
+	cur, err := a.mdb.Collection("org_invitations").Find(a.ctx, filter)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &invitations); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(invitations)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// AcceptInvitation adds the current user to the organization they were
+// invited to, with the role of the invitation.
+func (a API) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusForbidden)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invitation not found.", 404)
+		return
+	}
+	var invitation model.OrgInvitation
+	filter := bson.M{"_id": id, "email": user.Email, "expires_at": bson.M{"$gt": time.Now()}}
+	err = a.mdb.Collection("org_invitations").FindOneAndDelete(a.ctx, filter).Decode(&invitation)
+	if err != nil {
+		http.Error(w, "Invitation not found.", 404)
+		return
+	}
+
+	member := model.OrgMember{Email: user.Email, Role: invitation.Role, JoinedAt: time.Now()}
+	update := bson.M{"$push": bson.M{"members": member}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var org model.Organization
+	err = a.mdb.Collection("organizations").FindOneAndUpdate(a.ctx, bson.M{"_id": invitation.OrgID, "members.email": bson.M{"$ne": user.Email}}, update, opts).Decode(&org)
+	if err != nil {
+		http.Error(w, "Organization not found, or already a member.", 404)
+		return
+	}
+
+	js, _ := json.Marshal(org)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// UpdateMember changes the role of a member. Owners and admins can make
+// members admins and back; only owners can add or remove owners, and an
+// organization always keeps one.
+func (a API) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	_, org, role, err := a.getMemberOrg(w, r)
+	if err != nil || !canManage(role) {
+		http.Error(w, "Only owners and admins can change roles.", http.StatusForbidden)
+		return
+	}
+
+	var request memberRequest
+	if err = a.marshallBody(&request, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !validOrgRole(request.Role) {
+		http.Error(w, "Role must be owner, admin or member.", 400)
+		return
+	}
+
+	email := mux.Vars(r)["email"]
+	current := orgRole(org, email)
+	if current == "" {
+		http.Error(w, "Member not found.", 404)
+		return
+	}
+	if (current == model.OrgRoleOwner || request.Role == model.OrgRoleOwner) && role != model.OrgRoleOwner {
+		http.Error(w, "Only owners can add or remove owners.", http.StatusForbidden)
+		return
+	}
+	if current == model.OrgRoleOwner && request.Role != model.OrgRoleOwner && countOwners(org) == 1 {
+		http.Error(w, "An organization needs an owner. Make someone else owner first.", http.StatusConflict)
+		return
+	}
+
+	filter := bson.M{"_id": org.ID, "members.email": email}
+	update := bson.M{"$set": bson.M{"members.$.role": request.Role}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err = a.mdb.Collection("organizations").FindOneAndUpdate(a.ctx, filter, update, opts).Decode(&org); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(org)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// RemoveMember removes someone from an organization. Members can always
+// leave; owners and admins can remove others, and only owners can remove
+// owners. The last owner can't leave.
+func (a API) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	user, org, role, err := a.getMemberOrg(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	email := mux.Vars(r)["email"]
+	current := orgRole(org, email)
+	if current == "" {
+		http.Error(w, "Member not found.", 404)
+		return
+	}
+	if email != user.Email && (!canManage(role) || (current == model.OrgRoleOwner && role != model.OrgRoleOwner)) {
+		http.Error(w, "Not allowed to remove this member.", http.StatusForbidden)
+		return
+	}
+	if current == model.OrgRoleOwner && countOwners(org) == 1 {
+		http.Error(w, "An organization needs an owner. Make someone else owner first.", http.StatusConflict)
+		return
+	}
+
+	update := bson.M{"$pull": bson.M{"members": bson.M{"email": email}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err = a.mdb.Collection("organizations").FindOneAndUpdate(a.ctx, bson.M{"_id": org.ID}, update, opts).Decode(&org); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(org)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// applyPlan checks the plan of a new server and sets the resources it is
+// deployed with. Limits in the server's config may be lower than the plan's
+// but not higher.
+func applyPlan(server *model.WebsocketServer) error {
+	if server.Plan == "" {
+		server.Plan = model.DefaultPlan
+	}
+	plan, ok := model.FindPlan(server.Plan)
+	if !ok {
+		names := []string{}
+		for _, plan := range model.Plans {
+			names = append(names, plan.Name)
+		}
+		return fmt.Errorf("%q is not a plan. Use one of %v.", server.Plan, names)
+	}
+
+	config := server.Config
+	if config.MaxConnections > plan.MaxConnections {
+		return fmt.Errorf("max_connections can be at most %d on the %s plan.", plan.MaxConnections, plan.Name)
+	}
+	if config.MaxRooms > plan.MaxRooms {
+		return fmt.Errorf("max_rooms can be at most %d on the %s plan.", plan.MaxRooms, plan.Name)
+	}
+	if config.MessagesPerMinute > plan.MessagesPerMinute {
+		return fmt.Errorf("messages_per_minute can be at most %d on the %s plan.", plan.MessagesPerMinute, plan.Name)
+	}
+
+	server.CPU = strconv.Itoa(plan.CPU) + "m"
+	server.Memory = strconv.Itoa(plan.Memory) + "Mi"
+	return nil
+}
+
+// ownerUsage adds up the servers that haven't been deleted of an
+// organization, or the personal servers of a user when orgID is nil.
+// Servers from before plans count towards the number of servers only.
+func (a API) ownerUsage(email string, orgID *primitive.ObjectID) (model.QuotaUsage, error) {
+	usage := model.QuotaUsage{Quota: model.DefaultQuota}
+	filter := bson.M{"status": bson.M{"$ne": model.ServerDeleted}}
+	if orgID != nil {
+		org, err := a.findOrg(*orgID)
+		if err != nil {
+			return usage, err
+		}
+		if org.Quota != nil {
+			usage.Quota = *org.Quota
+		}
+		filter["org_id"] = org.ID
+	} else {
+		var user model.User
+		if err := a.mdb.Collection("users").FindOne(a.ctx, bson.D{{Key: "email", Value: email}}).Decode(&user); err != nil {
+			return usage, err
+		}
+		if user.Quota != nil {
+			usage.Quota = *user.Quota
+		}
+		filter["user_email"] = email
+		filter["org_id"] = nil
+	}
+
+	var servers []model.WebsocketServer
+	cur, err := a.mdb.Collection("servers").Find(a.ctx, filter)
+	if err != nil {
+		return usage, err
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &servers); err != nil {
+		return usage, err
+	}
+
+	for _, server := range servers {
+		used := serverUsage(server)
+		usage.Used.MaxServers += used.MaxServers
+		usage.Used.CPU += used.CPU
+		usage.Used.Memory += used.Memory
+	}
+	return usage, nil
+}
+
+// serverUsage is what a server counts towards its owner's quota: its plan's
+// resources for every replica.
+func serverUsage(server model.WebsocketServer) model.Quota {
+	used := model.Quota{MaxServers: 1}
+	if plan, ok := model.FindPlan(server.Plan); ok {
+		used.CPU = plan.CPU * server.Instances()
+		used.Memory = plan.Memory * server.Instances()
+	}
+	return used
+}
+
+// checkQuota reports whether adding extra to what a user uses fits in their
+// quota. Only increases are checked, so users over their quota can still
+// scale down. Two requests at the same moment may both fit; the quota is a
+// guard, not an exact limit.
+func checkQuota(usage model.QuotaUsage, extra model.Quota) error {
+	quota, used := usage.Quota, usage.Used
+	if extra.MaxServers > 0 && used.MaxServers+extra.MaxServers > quota.MaxServers {
+		return fmt.Errorf("Quota exceeded: you can have at most %d servers and have %d.", quota.MaxServers, used.MaxServers)
+	}
+	if extra.CPU > 0 && used.CPU+extra.CPU > quota.CPU {
+		return fmt.Errorf("Quota exceeded: this needs %dm more CPU but only %dm of your %dm is left.", extra.CPU, quota.CPU-used.CPU, quota.CPU)
+	}
+	if extra.Memory > 0 && used.Memory+extra.Memory > quota.Memory {
+		return fmt.Errorf("Quota exceeded: this needs %dMi more memory but only %dMi of your %dMi is left.", extra.Memory, quota.Memory-used.Memory, quota.Memory)
+	}
+	return nil
+}
+
+func (a API) FetchPlans(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(model.Plans)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// FetchQuota returns the quota of the current user and how much of it their
+// personal servers use.
+func (a API) FetchQuota(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusForbidden)
+		return
+	}
+
+	usage, err := a.ownerUsage(user.Email, nil)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(usage)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// UpdateUserQuota lets admins raise or lower the quota of a user.
+func (a API) UpdateUserQuota(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil || user.Rank != "Admin" {
+		http.Error(w, "Only admins can change quotas.", http.StatusForbidden)
+		return
+	}
+
+	var quota model.Quota
+	if err = a.marshallBody(&quota, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if quota.MaxServers < 0 || quota.CPU < 0 || quota.Memory < 0 {
+		http.Error(w, "Quotas can't be negative.", 400)
+		return
+	}
+
+	result, err := a.mdb.Collection("users").UpdateOne(a.ctx, bson.D{{Key: "email", Value: mux.Vars(r)["email"]}}, bson.M{"$set": bson.M{"quota": quota}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "User not found.", 404)
+		return
+	}
+
+	js, _ := json.Marshal(quota)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/mux"
+)
+
+type publishRequest struct {
+	Room string          `json:"room"`
+	Data json.RawMessage `json:"data"`
+	// Binary messages carry base64 encoded data.
+	Binary bool `json:"binary,omitempty"`
+}
+
+type publishResult struct {
+	Room      string `json:"room"`
+	Delivered int    `json:"delivered"`
+	// Why the message hooks rejected the message, if they did.
+	Error string `json:"error,omitempty"`
+}
+
+type batchPublishResult struct {
+	Results   []publishResult `json:"results"`
+	Delivered int             `json:"delivered"`
+}
+
+// MessageData returns the text message to deliver for published data. JSON
+// strings are unwrapped, so they are delivered as sent rather than quoted;
+// anything else is delivered as is.
+func MessageData(raw []byte) []byte {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []byte(text)
+	}
+	return raw
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// isBinaryContent reports whether the request body should be delivered in
+// binary frames.
+func isBinaryContent(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/octet-stream")
+}
+
+func (a API) PublishRoomMessage(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getServerByApiKey(r, model.ScopePublish)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if a.realtime == nil {
+		http.Error(w, "Websockets are not available.", 500)
+		return
+	}
+
+	room := mux.Vars(r)["room"]
+	body, err := a.readBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(body) == 0 {
+		http.Error(w, "Message body is empty.", 400)
+		return
+	}
+
+	binary := isBinaryContent(r)
+	if !binary {
+		body = MessageData(body)
+	}
+	delivered, err := a.realtime.Publish(server, room, body, binary)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	result := publishResult{Room: room, Delivered: delivered}
+
+	js, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) PublishRoomMessages(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getServerByApiKey(r, model.ScopePublish)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if a.realtime == nil {
+		http.Error(w, "Websockets are not available.", 500)
+		return
+	}
+
+	var messages []publishRequest
+	err = a.marshallBody(&messages, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	payloads := make([][]byte, len(messages))
+	for i, message := range messages {
+		if message.Room == "" || len(message.Data) == 0 {
+			http.Error(w, "Every message needs a room and data.", 400)
+			return
+		}
+		if !message.Binary {
+			payloads[i] = MessageData(message.Data)
+			continue
+		}
+
+		var encoded string
+		if err := json.Unmarshal(message.Data, &encoded); err != nil {
+			http.Error(w, "Binary data must be a base64 string.", 400)
+			return
+		}
+		if payloads[i], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			http.Error(w, "Binary data must be a base64 string.", 400)
+			return
+		}
+	}
+
+	var result batchPublishResult
+	result.Results = []publishResult{}
+	for i, message := range messages {
+		delivered, err := a.realtime.Publish(server, message.Room, payloads[i], message.Binary)
+		result.Results = append(result.Results, publishResult{Room: message.Room, Delivered: delivered, Error: errorText(err)})
+		result.Delivered += delivered
+	}
+
+	js, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+// Realtime delivers messages to clients connected to the websocket hub.
+type Realtime interface {
+	// SendToUser delivers data to every connection of the user and returns
+	// how many connections received it.
+	SendToUser(email string, data []byte) int
+	// SendToConnection delivers data to a single connection by id.
+	SendToConnection(id string, data []byte) bool
+	// Publish broadcasts data to a room of a websocket server and returns
+	// how many connections received it. Binary data is delivered in binary
+	// frames. An error means the server's message hooks rejected the data.
+	Publish(server model.WebsocketServer, room string, data []byte, binary bool) (int, error)
+	// Inspect describes the rooms and connections of a websocket server.
+	Inspect(serverUUID string) model.ServerSnapshot
+	// ApplyConfig applies the config of a websocket server to its open
+	// connections, unless they already have that version or a newer one.
+	ApplyConfig(server model.WebsocketServer)
+}
+
+func (a *API) SetRealtime(rt Realtime) {
+	a.realtime = rt
+}
+
+func (a API) notifyUser(email string, payload interface{}) int {
+	if a.realtime == nil {
+		return 0
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Println("Error marshalling notification:", err)
+		return 0
+	}
+
+	return a.realtime.SendToUser(email, data)
+}
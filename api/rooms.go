@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func validateRoom(room model.Room) error {
+	if room.Name == "" {
+		return errors.New("Please enter a room name.")
+	}
+
+	validRole := func(role string) bool {
+		return role == model.RoomRoleRead || role == model.RoomRoleWrite
+	}
+
+	if room.DefaultRole != "" && !validRole(room.DefaultRole) {
+		return errors.New("default_role must be read or write.")
+	}
+	for _, member := range room.Members {
+		if member.Identity == "" || !validRole(member.Role) {
+			return errors.New("Every member needs an identity and a read or write role.")
+		}
+	}
+	for _, pattern := range room.Patterns {
+		if _, err := path.Match(pattern.Identity, ""); err != nil || pattern.Identity == "" {
+			return errors.New("Invalid member pattern " + pattern.Identity + ".")
+		}
+		if !validRole(pattern.Role) {
+			return errors.New("Every pattern needs a read or write role.")
+		}
+	}
+
+	return nil
+}
+
+// roomRole returns the role of identity in a room, or "" if it may not join.
+// Owners and explicit members take precedence over patterns, and the best
+// matching role wins.
+func roomRole(room model.Room, identity string) string {
+	for _, owner := range room.Owners {
+		if identity != "" && owner == identity {
+			return model.RoomRoleWrite
+		}
+	}
+
+	role := ""
+	for _, member := range room.Members {
+		if identity != "" && member.Identity == identity {
+			return member.Role
+		}
+	}
+	for _, pattern := range room.Patterns {
+		if matched, _ := path.Match(pattern.Identity, identity); matched && identity != "" {
+			if pattern.Role == model.RoomRoleWrite {
+				return model.RoomRoleWrite
+			}
+			role = pattern.Role
+		}
+	}
+	if role != "" || room.Private {
+		return role
+	}
+
+	if room.DefaultRole == "" {
+		return model.RoomRoleWrite
+	}
+	return room.DefaultRole
+}
+
+// RoomRole returns the role of identity in a room of a server, or "" if it
+// may not join the room.
+func (a API) RoomRole(serverUUID string, name string, identity string) (string, error) {
+	var room model.Room
+	err := a.mdb.Collection("rooms").FindOne(a.ctx, bson.D{{Key: "server_uuid", Value: serverUUID}, {Key: "name", Value: name}}).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return model.RoomRoleWrite, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return roomRole(room, identity), nil
+}
+
+func (a API) FetchRooms(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	rooms := []model.Room{}
+	cur, err := a.mdb.Collection("rooms").Find(a.ctx, bson.D{{Key: "server_uuid", Value: server.UUID}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &rooms); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(rooms)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) FetchRoom(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var room model.Room
+	err = a.mdb.Collection("rooms").FindOne(a.ctx, bson.D{{Key: "server_uuid", Value: server.UUID}, {Key: "name", Value: mux.Vars(r)["room"]}}).Decode(&room)
+	if err != nil {
+		http.Error(w, "Room not found.", 404)
+		return
+	}
+
+	js, _ := json.Marshal(room)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) CreateRoom(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getManagedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var room model.Room
+	err = a.marshallBody(&room, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err = validateRoom(room); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	room.ServerUUID = server.UUID
+	room.CreatedAt = time.Now()
+
+	_, err = a.mdb.Collection("rooms").InsertOne(a.ctx, room)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "Room already exists.", 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(room)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) UpdateRoom(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getManagedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var room model.Room
+	err = a.marshallBody(&room, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	room.Name = mux.Vars(r)["room"]
+	if err = validateRoom(room); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{
+		"private":      room.Private,
+		"owners":       room.Owners,
+		"members":      room.Members,
+		"patterns":     room.Patterns,
+		"default_role": room.DefaultRole,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var saved model.Room
+	err = a.mdb.Collection("rooms").FindOneAndUpdate(a.ctx, bson.D{{Key: "server_uuid", Value: server.UUID}, {Key: "name", Value: room.Name}}, update, opts).Decode(&saved)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Room not found.", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(saved)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getManagedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	name := mux.Vars(r)["room"]
+	result, err := a.mdb.Collection("rooms").DeleteOne(a.ctx, bson.D{{Key: "server_uuid", Value: server.UUID}, {Key: "name", Value: name}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Room not found.", 404)
+		return
+	}
+
+	js, _ := json.Marshal(name)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
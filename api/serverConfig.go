@@ -0,0 +1,150 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+const (
+	maxSendBufferSize = 65536
+	maxMessageSize    = 16 << 20
+	maxSessionGrace   = 3600
+	maxKeepalive      = 3600
+)
+
+func validateServerConfig(config model.ServerConfig) error {
+	if config.SendBufferSize < 0 || config.SendBufferSize > maxSendBufferSize {
+		return errors.New("send_buffer_size must be between 1 and 65536.")
+	}
+
+	switch config.SlowConsumerPolicy {
+	case "", model.SlowConsumerDropOldest, model.SlowConsumerDropNewest, model.SlowConsumerDisconnect, model.SlowConsumerBlock:
+	default:
+		return errors.New("slow_consumer_policy must be one of drop_oldest, drop_newest, disconnect or block.")
+	}
+
+	if config.BlockTimeoutMs < 0 {
+		return errors.New("block_timeout_ms can't be negative.")
+	}
+
+	if config.MaxMessageSize < 0 || config.MaxMessageSize > maxMessageSize {
+		return errors.New("max_message_size must be between 1 and 16777216 bytes.")
+	}
+
+	if config.MaxConnections < 0 || config.MaxRooms < 0 || config.MaxConnectionsPerUser < 0 || config.MaxConnectionsPerToken < 0 || config.MaxConnectionsPerIP < 0 {
+		return errors.New("Connection limits can't be negative.")
+	}
+
+	if config.ConnectionsPerMinute < 0 {
+		return errors.New("connections_per_minute can't be negative.")
+	}
+
+	if config.MessagesPerMinute < 0 || config.UserMessagesPerMinute < 0 || config.RoomMessagesPerMinute < 0 || config.MessageBurst < 0 || config.MaxRateViolations < 0 {
+		return errors.New("Message rate limits can't be negative.")
+	}
+
+	if config.SessionGraceSeconds < 0 || config.SessionGraceSeconds > maxSessionGrace {
+		return errors.New("session_grace_seconds must be between 1 and 3600.")
+	}
+
+	if err := validateKeepalive(config); err != nil {
+		return err
+	}
+
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("%q is not a valid origin. Use the form https://example.com.", origin)
+		}
+	}
+
+	for _, hook := range config.Hooks {
+		if err := validateHook(hook); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateKeepalive checks the keepalive timings, which must leave clients
+// time to answer a ping before they are considered gone.
+func validateKeepalive(config model.ServerConfig) error {
+	for _, seconds := range []int{config.PingIntervalSeconds, config.PongTimeoutSeconds, config.WriteTimeoutSeconds} {
+		if seconds < 0 || seconds > maxKeepalive {
+			return errors.New("Keepalive timings must be between 1 and 3600 seconds.")
+		}
+	}
+
+	ping, pong := config.PingIntervalSeconds, config.PongTimeoutSeconds
+	if ping == 0 {
+		ping = model.DefaultPingIntervalSeconds
+	}
+	if pong == 0 {
+		pong = model.DefaultPongTimeoutSeconds
+	}
+	if ping >= pong {
+		return fmt.Errorf("ping_interval_seconds (%d) must be shorter than pong_timeout_seconds (%d).", ping, pong)
+	}
+	return nil
+}
+
+func validateHook(hook model.HookConfig) error {
+	for _, room := range hook.Rooms {
+		if _, err := path.Match(room, ""); err != nil {
+			return fmt.Errorf("%q is not a valid room pattern.", room)
+		}
+	}
+
+	switch hook.Type {
+	case model.HookProfanity:
+		if len(hook.Words) == 0 {
+			return errors.New("Profanity hooks need a list of words.")
+		}
+		switch hook.Action {
+		case "", model.ProfanityReject, model.ProfanityMask, model.ProfanityDrop:
+		default:
+			return errors.New("Profanity hook action must be reject, mask or drop.")
+		}
+	case model.HookStripFields:
+		if len(hook.Fields) == 0 {
+			return errors.New("Strip fields hooks need a list of fields.")
+		}
+	case model.HookJSONSchema:
+		if hook.Schema == nil {
+			return errors.New("JSON schema hooks need a schema.")
+		}
+		return validateSchemaDefinition(hook.Schema)
+	case model.HookEnrich:
+	default:
+		return fmt.Errorf("%q is not a hook type. Use profanity, strip_fields, json_schema or enrich.", hook.Type)
+	}
+
+	return nil
+}
+
+func validateSchemaDefinition(schema *model.JSONSchema) error {
+	if schema == nil {
+		return nil
+	}
+
+	switch schema.Type {
+	case "", "object", "array", "string", "number", "integer", "boolean", "null":
+	default:
+		return fmt.Errorf("%q is not a schema type.", schema.Type)
+	}
+
+	for _, property := range schema.Properties {
+		if err := validateSchemaDefinition(property); err != nil {
+			return err
+		}
+	}
+	return validateSchemaDefinition(schema.Items)
+}
@@ -0,0 +1,492 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	serverEventQueueSize     = 4096
+	serverEventBatchSize     = 100
+	serverEventFlushInterval = time.Second
+	// Events one process logs per server each minute. The rest are counted
+	// in an events.dropped event.
+	serverEventsPerMinute = 600
+
+	serverEventPollInterval = time.Second
+	// Events are written in batches and by several processes, so streams
+	// look back this far for events they haven't seen.
+	serverEventLookback     = 5 * time.Second
+	serverEventStreamBuffer = 64
+	serverEventKeepAlive    = 15 * time.Second
+
+	defaultServerEvents = 100
+	maxServerEvents     = 1000
+)
+
+// serverEventLog queues events for storage and hands out new ones to live
+// streams.
+type serverEventLog struct {
+	events chan model.ServerEvent
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan model.ServerEvent]struct{}
+	polling     bool
+	// Closed on shutdown to end the streams.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newServerEventLog() *serverEventLog {
+	return &serverEventLog{
+		events:      make(chan model.ServerEvent, serverEventQueueSize),
+		subscribers: make(map[string]map[chan model.ServerEvent]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// eventRetention is how long the events of a server are kept, set by its
+// plan.
+func eventRetention(server model.WebsocketServer) time.Duration {
+	plan, ok := model.FindPlan(server.Plan)
+	if !ok {
+		plan, _ = model.FindPlan(model.DefaultPlan)
+	}
+	return time.Duration(plan.EventRetentionDays) * 24 * time.Hour
+}
+
+// LogServerEvent queues an event for the log of a server. It never blocks;
+// events are dropped if the queue is full.
+func (a API) LogServerEvent(server model.WebsocketServer, event model.ServerEvent) {
+	if a.serverEvents == nil || server.UUID == "" || server.UUID == userServerUUID {
+		return
+	}
+
+	event.ServerUUID = server.UUID
+	if event.Level == "" {
+		event.Level = model.EventLevelInfo
+	}
+	event.CreatedAt = time.Now()
+	event.ExpiresAt = event.CreatedAt.Add(eventRetention(server))
+	select {
+	case a.serverEvents.events <- event:
+	default:
+		fmt.Println("Server event queue full, dropping event:", event.Type)
+	}
+}
+
+// eventWindow counts the events of a server in the current minute.
+type eventWindow struct {
+	start     time.Time
+	count     int
+	dropped   int
+	retention time.Duration
+}
+
+// eventWriter batches events into storage, applying the rate limit.
+type eventWriter struct {
+	a       API
+	windows map[string]*eventWindow
+	batch   []interface{}
+}
+
+func (ew *eventWriter) add(event model.ServerEvent) {
+	window := ew.windows[event.ServerUUID]
+	if window != nil && time.Since(window.start) >= time.Minute {
+		ew.close(event.ServerUUID, window)
+		window = nil
+	}
+	if window == nil {
+		window = &eventWindow{start: time.Now()}
+		ew.windows[event.ServerUUID] = window
+	}
+	window.retention = event.ExpiresAt.Sub(event.CreatedAt)
+
+	if window.count >= serverEventsPerMinute {
+		window.dropped++
+		return
+	}
+	window.count++
+	ew.batch = append(ew.batch, event)
+}
+
+// close ends the window of a server, logging how many events it dropped.
+func (ew *eventWriter) close(serverUUID string, window *eventWindow) {
+	delete(ew.windows, serverUUID)
+	if window.dropped == 0 {
+		return
+	}
+
+	now := time.Now()
+	ew.batch = append(ew.batch, model.ServerEvent{
+		ServerUUID: serverUUID,
+		Type:       model.ServerEventsDropped,
+		Level:      model.EventLevelWarning,
+		Message:    fmt.Sprintf("%d events were dropped. Each instance logs up to %d events a minute.", window.dropped, serverEventsPerMinute),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(window.retention),
+	})
+}
+
+// expire ends the windows that are over a minute old.
+func (ew *eventWriter) expire() {
+	for uuid, window := range ew.windows {
+		if time.Since(window.start) >= time.Minute {
+			ew.close(uuid, window)
+		}
+	}
+}
+
+func (ew *eventWriter) flush() {
+	if len(ew.batch) == 0 {
+		return
+	}
+	if _, err := ew.a.mdb.Collection("server_events").InsertMany(ew.a.ctx, ew.batch); err != nil {
+		fmt.Println("Error saving server events:", err)
+	}
+	ew.batch = nil
+}
+
+// RunServerEvents writes logged events to storage until ctx is done, then
+// writes what is left. Every process runs it, since instances log the
+// events of their own connections.
+func (a API) RunServerEvents(ctx context.Context) {
+	ticker := time.NewTicker(serverEventFlushInterval)
+	defer ticker.Stop()
+
+	writer := &eventWriter{a: a, windows: make(map[string]*eventWindow)}
+	for {
+		select {
+		case event := <-a.serverEvents.events:
+			writer.add(event)
+			if len(writer.batch) >= serverEventBatchSize {
+				writer.flush()
+			}
+		case <-ticker.C:
+			writer.expire()
+			writer.flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case event := <-a.serverEvents.events:
+					writer.add(event)
+				default:
+					writer.flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// CloseServerEventStreams ends the live event streams, on shutdown.
+func (a API) CloseServerEventStreams() {
+	a.serverEvents.closeOnce.Do(func() {
+		close(a.serverEvents.closed)
+	})
+}
+
+// SubscribeServerEvents returns a channel of new events of a server and a
+// function to stop them, which closes the channel. Events are dropped if
+// the subscriber falls behind.
+func (a API) SubscribeServerEvents(serverUUID string) (<-chan model.ServerEvent, func()) {
+	eventLog := a.serverEvents
+	events := make(chan model.ServerEvent, serverEventStreamBuffer)
+
+	eventLog.mu.Lock()
+	if eventLog.subscribers[serverUUID] == nil {
+		eventLog.subscribers[serverUUID] = make(map[chan model.ServerEvent]struct{})
+	}
+	eventLog.subscribers[serverUUID][events] = struct{}{}
+	if !eventLog.polling {
+		eventLog.polling = true
+		go a.pollServerEvents()
+	}
+	eventLog.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			eventLog.mu.Lock()
+			delete(eventLog.subscribers[serverUUID], events)
+			if len(eventLog.subscribers[serverUUID]) == 0 {
+				delete(eventLog.subscribers, serverUUID)
+			}
+			close(events)
+			eventLog.mu.Unlock()
+		})
+	}
+	return events, cancel
+}
+
+// subscribed returns the servers with subscribers, or nil and stops polling
+// if there are none.
+func (l *serverEventLog) subscribed() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.subscribers) == 0 {
+		l.polling = false
+		return nil
+	}
+	uuids := make([]string, 0, len(l.subscribers))
+	for uuid := range l.subscribers {
+		uuids = append(uuids, uuid)
+	}
+	return uuids
+}
+
+func (l *serverEventLog) publish(event model.ServerEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for events := range l.subscribers[event.ServerUUID] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// pollServerEvents reads new events of the servers with subscribers and
+// hands them out until nobody is subscribed. Events of every process go
+// through storage, so streams include those of deployed instances.
+func (a API) pollServerEvents() {
+	ticker := time.NewTicker(serverEventPollInterval)
+	defer ticker.Stop()
+
+	seen := make(map[primitive.ObjectID]time.Time)
+	for range ticker.C {
+		uuids := a.serverEvents.subscribed()
+		if uuids == nil {
+			return
+		}
+
+		now := time.Now()
+		filter := bson.M{
+			"server_uuid": bson.M{"$in": uuids},
+			"_id":         bson.M{"$gte": primitive.NewObjectIDFromTimestamp(now.Add(-serverEventLookback))},
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(maxServerEvents)
+		var events []model.ServerEvent
+		cur, err := a.mdb.Collection("server_events").Find(a.ctx, filter, opts)
+		if err == nil {
+			err = cur.All(a.ctx, &events)
+		}
+		if err != nil {
+			fmt.Println("Error reading server events:", err)
+			continue
+		}
+
+		for _, event := range events {
+			if _, ok := seen[event.ID]; ok {
+				continue
+			}
+			seen[event.ID] = now
+			a.serverEvents.publish(event)
+		}
+		for id, at := range seen {
+			if now.Sub(at) > 2*serverEventLookback {
+				delete(seen, id)
+			}
+		}
+	}
+}
+
+// CanWatchServer reports whether a user may follow the events of a server.
+func (a API) CanWatchServer(email string, serverUUID string) bool {
+	server, err := a.GetWSServerByUUID(serverUUID)
+	if err != nil {
+		return false
+	}
+	return a.ownsServer(model.User{Email: email}, server)
+}
+
+// eventFilter matches events by type and level, from the type and level
+// query parameters. type may list several types separated by commas.
+type eventFilter struct {
+	types []string
+	level string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	filter := eventFilter{level: r.URL.Query().Get("level")}
+	if types := r.URL.Query().Get("type"); types != "" {
+		filter.types = strings.Split(types, ",")
+	}
+	return filter
+}
+
+func (f eventFilter) query(serverUUID string) bson.M {
+	query := bson.M{"server_uuid": serverUUID}
+	if len(f.types) > 0 {
+		query["type"] = bson.M{"$in": f.types}
+	}
+	if f.level != "" {
+		query["level"] = f.level
+	}
+	return query
+}
+
+func (f eventFilter) matches(event model.ServerEvent) bool {
+	if f.level != "" && event.Level != f.level {
+		return false
+	}
+	if len(f.types) == 0 {
+		return true
+	}
+	for _, t := range f.types {
+		if event.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchServerEvents returns the events of a server, newest first. Filter
+// them with type, level, since and until, and page back with before, the id
+// of the oldest event of the previous page.
+func (a API) FetchServerEvents(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	query := newEventFilter(r).query(server.UUID)
+	createdAt := bson.M{}
+	for param, operator := range map[string]string{"since": "$gte", "until": "$lt"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, param+" must be an RFC 3339 time.", 400)
+			return
+		}
+		createdAt[operator] = at
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
+	}
+	if before := r.URL.Query().Get("before"); before != "" {
+		id, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			http.Error(w, "before must be the id of an event.", 400)
+			return
+		}
+		query["_id"] = bson.M{"$lt": id}
+	}
+
+	limit := defaultServerEvents
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxServerEvents {
+			http.Error(w, "limit must be between 1 and 1000.", 400)
+			return
+		}
+	}
+
+	events := []model.ServerEvent{}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cur, err := a.mdb.Collection("server_events").Find(a.ctx, query, opts)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &events); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(events)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func writeServerEvent(w http.ResponseWriter, event model.ServerEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID.Hex(), event.Type, data)
+}
+
+// StreamServerEvents streams the events of a server as server-sent events,
+// with the same type and level filters as FetchServerEvents. Clients that
+// reconnect with Last-Event-ID get the events they missed first.
+func (a API) StreamServerEvents(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", 500)
+		return
+	}
+
+	filter := newEventFilter(r)
+	events, cancel := a.SubscribeServerEvents(server.UUID)
+	defer cancel()
+
+	// Missed events may also arrive live; they are only sent once.
+	missed := []model.ServerEvent{}
+	if last, err := primitive.ObjectIDFromHex(r.Header.Get("Last-Event-ID")); err == nil {
+		query := filter.query(server.UUID)
+		query["_id"] = bson.M{"$gt": last}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(maxServerEvents)
+		cur, err := a.mdb.Collection("server_events").Find(a.ctx, query, opts)
+		if err == nil {
+			err = cur.All(a.ctx, &missed)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sent := make(map[primitive.ObjectID]bool, len(missed))
+	for _, event := range missed {
+		writeServerEvent(w, event)
+		sent[event.ID] = true
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(serverEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if sent[event.ID] || !filter.matches(event) {
+				continue
+			}
+			writeServerEvent(w, event)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-a.serverEvents.closed:
+			return
+		}
+	}
+}
@@ -12,6 +12,19 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// canAccessTicket reports whether a user may see and reply to a ticket: its
+// author, members of its organization and admins can.
+func (a API) canAccessTicket(user model.User, ticket model.SupportTicket) bool {
+	if ticket.UserEmail == user.Email || user.Rank == "Admin" {
+		return true
+	}
+	if ticket.OrgID == nil {
+		return false
+	}
+	org, err := a.findOrg(*ticket.OrgID)
+	return err == nil && orgRole(org, user.Email) != ""
+}
+
 func (a API) FetchSupportTickets(w http.ResponseWriter, r *http.Request) {
 	user, err := a.getUserByToken(w, r)
 	if err != nil {
@@ -19,8 +32,19 @@ func (a API) FetchSupportTickets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	orgIDs, err := a.userOrgIDs(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// The user's own tickets and those filed for their organizations.
 	var tickets []model.SupportTicket
-	cur, err := a.mdb.Collection("tickets").Find(a.ctx, bson.D{{Key: "user_email", Value: user.Email}})
+	filter := bson.M{"$or": bson.A{
+		bson.M{"user_email": user.Email},
+		bson.M{"org_id": bson.M{"$in": orgIDs}},
+	}}
+	cur, err := a.mdb.Collection("tickets").Find(a.ctx, filter)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -75,7 +99,7 @@ func (a API) FetchSupportTicket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if ticket.UserEmail != user.Email || user.Rank != "Admin" {
+	if !a.canAccessTicket(user, ticket) {
 		http.Error(w, "Unable to retrive ticket.", 500)
 		return
 	}
@@ -101,6 +125,13 @@ func (a API) CreateSupportTicket(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing required ticket fields.", 500)
 		return
 	}
+	if ticket.OrgID != nil {
+		org, err := a.findOrg(*ticket.OrgID)
+		if err != nil || orgRole(org, user.Email) == "" {
+			http.Error(w, "Not a member of this organization.", http.StatusForbidden)
+			return
+		}
+	}
 	ticket.UserEmail = user.Email
 	ticket.UserName = user.FullName
 	ticket.CreatedAt = time.Now()
@@ -116,6 +147,7 @@ func (a API) CreateSupportTicket(w http.ResponseWriter, r *http.Request) {
 
 	update := bson.M{"$set": bson.M{"number": ticket.Number}}
 	a.mdb.Collection("tickets").UpdateOne(a.ctx, bson.D{{Key: "_id", Value: ticket.ID}}, update)
+	a.EmitEvent(ticket.UserEmail, "", model.EventTicketCreated, ticket)
 
 	js, err := json.Marshal(ticket)
 	w.Header().Set("Content-Type", "application/json")
@@ -147,6 +179,10 @@ func (a API) AddSupportReply(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Ticket not found.", 500)
 		return
 	}
+	if !a.canAccessTicket(user, ticket) {
+		http.Error(w, "Unable to reply to ticket.", http.StatusForbidden)
+		return
+	}
 	if ticket.Replies == nil {
 		ticket.Replies = []model.SupportTicketReply{reply}
 	} else {
@@ -161,6 +197,18 @@ func (a API) AddSupportReply(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ticket.UserEmail != user.Email {
+		a.notifyUser(ticket.UserEmail, map[string]interface{}{
+			"type":   "ticket.reply",
+			"ticket": ticket.Number,
+			"reply":  reply,
+		})
+	}
+	a.EmitEvent(ticket.UserEmail, "", model.EventTicketReply, map[string]interface{}{
+		"ticket": ticket.Number,
+		"reply":  reply,
+	})
+
 	js, err := json.Marshal(ticket)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultUsageRange = 24 * time.Hour
+	maxUsageRange     = 93 * 24 * time.Hour
+)
+
+var usageColumns = []string{"server_uuid", "hour", "connection_seconds", "messages_received", "messages_sent", "bytes_received", "bytes_sent"}
+
+// RecordUsage adds usage to the hourly record of a server. Every process
+// running the server records its own share.
+func (a API) RecordUsage(serverUUID string, at time.Time, usage model.Usage) error {
+	filter := bson.M{"server_uuid": serverUUID, "hour": at.UTC().Truncate(time.Hour)}
+	update := bson.M{"$inc": bson.M{
+		"connection_seconds": usage.ConnectionSeconds,
+		"messages_received":  usage.MessagesReceived,
+		"messages_sent":      usage.MessagesSent,
+		"bytes_received":     usage.BytesReceived,
+		"bytes_sent":         usage.BytesSent,
+	}}
+	_, err := a.mdb.Collection("usage").UpdateOne(a.ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func addUsage(total *model.Usage, usage model.Usage) {
+	total.ConnectionSeconds += usage.ConnectionSeconds
+	total.MessagesReceived += usage.MessagesReceived
+	total.MessagesSent += usage.MessagesSent
+	total.BytesReceived += usage.BytesReceived
+	total.BytesSent += usage.BytesSent
+}
+
+// usageRange reads the from and to query parameters, RFC 3339 times that
+// default to the last day.
+func usageRange(r *http.Request) (time.Time, time.Time, string) {
+	to := time.Now().UTC()
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return to, to, "to must be an RFC 3339 time."
+		}
+		to = parsed.UTC()
+	}
+
+	from := to.Add(-defaultUsageRange)
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return from, to, "from must be an RFC 3339 time."
+		}
+		from = parsed.UTC()
+	}
+
+	if !from.Before(to) {
+		return from, to, "from must be before to."
+	}
+	if to.Sub(from) > maxUsageRange {
+		return from, to, "The range can be at most 93 days."
+	}
+	return from, to, ""
+}
+
+// FetchServerUsage returns the hourly usage records of a server between from
+// and to, with their total. Records are included if their hour starts in
+// the range. Add format=csv, or accept text/csv, for a CSV export.
+func (a API) FetchServerUsage(w http.ResponseWriter, r *http.Request) {
+	server, err := a.getOwnedServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	from, to, invalid := usageRange(r)
+	if invalid != "" {
+		http.Error(w, invalid, 400)
+		return
+	}
+
+	report := model.UsageReport{ServerUUID: server.UUID, From: from, To: to, Records: []model.UsageRecord{}}
+	filter := bson.M{"server_uuid": server.UUID, "hour": bson.M{"$gte": from.Truncate(time.Hour), "$lt": to}}
+	opts := options.Find().SetSort(bson.D{{Key: "hour", Value: 1}})
+	cur, err := a.mdb.Collection("usage").Find(a.ctx, filter, opts)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &report.Records); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for _, record := range report.Records {
+		addUsage(&report.Total, record.Usage)
+	}
+
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		writeUsageCSV(w, report)
+		return
+	}
+
+	js, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func writeUsageCSV(w http.ResponseWriter, report model.UsageReport) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage-`+report.ServerUUID+`.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write(usageColumns)
+	for _, record := range report.Records {
+		writer.Write([]string{
+			record.ServerUUID,
+			record.Hour.UTC().Format(time.RFC3339),
+			strconv.FormatInt(record.ConnectionSeconds, 10),
+			strconv.FormatInt(record.MessagesReceived, 10),
+			strconv.FormatInt(record.MessagesSent, 10),
+			strconv.FormatInt(record.BytesReceived, 10),
+			strconv.FormatInt(record.BytesSent, 10),
+		})
+	}
+	writer.Flush()
+}
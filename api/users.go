@@ -37,6 +37,7 @@ func (a API) CreateUser(w http.ResponseWriter, r *http.Request) {
 	user.WS_Token = ws_token
 	user.Token = token
 	user.Rank = "User"
+	user.Quota = nil
 
 	result, err := a.mdb.Collection("users").InsertOne(a.ctx, user)
 
@@ -141,6 +142,19 @@ func (a API) GetUserByWSToken(token string) (model.User, error) {
 	return person, nil
 }
 
+// GetUserByEmail returns a user, for websocket clients that connect with a
+// ticket of the user server.
+func (a API) GetUserByEmail(email string) (model.User, error) {
+	var person model.User
+	err := a.mdb.Collection("users").FindOne(a.ctx, bson.D{{Key: "email", Value: email}}).Decode(&person)
+
+	if err != nil {
+		return model.User{}, err
+	}
+
+	return person, nil
+}
+
 func (a API) FetchUserByToken(w http.ResponseWriter, r *http.Request) {
 	user, err := a.getUserByToken(w, r)
 	if err != nil {
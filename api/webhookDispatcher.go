@@ -0,0 +1,381 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	webhookQueueSize    = 1024
+	webhookPollInterval = 5 * time.Second
+	webhookTimeout      = 10 * time.Second
+	// A claimed delivery is retried by the next poll if it isn't settled
+	// within the lease, e.g. because the process died mid-attempt.
+	webhookLease       = time.Minute
+	webhookWorkers     = 4
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookCacheTTL    = 30 * time.Second
+)
+
+// emittedEvent is an event waiting to be matched against webhooks.
+type emittedEvent struct {
+	owner string
+	event model.WebhookEvent
+}
+
+type cachedWebhooks struct {
+	webhooks []model.Webhook
+	expires  time.Time
+}
+
+// webhookDispatcher queues events for delivery. Events are matched against
+// webhooks and saved as deliveries by one goroutine, and deliveries are sent
+// by another so slow endpoints never hold up new events.
+type webhookDispatcher struct {
+	events chan emittedEvent
+	wake   chan struct{}
+	client *http.Client
+
+	// Webhooks by owner and server, so busy rooms don't look them up for
+	// every message.
+	mu    sync.Mutex
+	cache map[string]cachedWebhooks
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		events: make(chan emittedEvent, webhookQueueSize),
+		wake:   make(chan struct{}, 1),
+		client: newWebhookClient(),
+		cache:  make(map[string]cachedWebhooks),
+	}
+}
+
+func (d *webhookDispatcher) invalidate() {
+	d.mu.Lock()
+	d.cache = make(map[string]cachedWebhooks)
+	d.mu.Unlock()
+}
+
+func (d *webhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// EmitEvent queues an event for the webhooks of its owner and server, and for
+// the account webhooks of the server's current users. It never blocks; events are dropped if the queue is full. data must not be
+// changed afterwards.
+func (a API) EmitEvent(owner string, serverUUID string, eventType string, data interface{}) {
+	if a.webhooks == nil || (owner == "" && serverUUID == "") {
+		return
+	}
+
+	event := emittedEvent{owner: owner, event: model.WebhookEvent{
+		ID:         primitive.NewObjectID().Hex(),
+		Type:       eventType,
+		ServerUUID: serverUUID,
+		CreatedAt:  time.Now(),
+		Data:       data,
+	}}
+	select {
+	case a.webhooks.events <- event:
+	default:
+		fmt.Println("Webhook queue full, dropping event:", eventType)
+	}
+}
+
+// RunWebhooks delivers webhook events until ctx is done.
+func (a API) RunWebhooks(ctx context.Context) {
+	go a.deliverWebhooks(ctx)
+
+	for {
+		select {
+		case emitted := <-a.webhooks.events:
+			if a.queueDeliveries(emitted) {
+				a.webhooks.notify()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// subscribedWebhooks returns the active webhooks of an owner and server.
+// Events of a server also go to the account webhooks of its current users:
+// its creator, or the members of its organization.
+func (a API) subscribedWebhooks(owner string, serverUUID string) ([]model.Webhook, error) {
+	key := owner + "\x00" + serverUUID
+	d := a.webhooks
+	d.mu.Lock()
+	cached, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.webhooks, nil
+	}
+
+	users := []string{}
+	if owner != "" {
+		users = append(users, owner)
+	}
+	scopes := bson.A{}
+	var server *model.WebsocketServer
+	if serverUUID != "" {
+		if found, err := a.GetWSServerByUUID(serverUUID); err == nil && found.DesiredState != model.DesiredDeleted {
+			server = &found
+			users = append(users, a.serverUsers(found)...)
+			scopes = append(scopes, bson.M{"server_uuid": serverUUID})
+		}
+	}
+	if len(users) > 0 {
+		scopes = append(scopes, bson.M{"user_email": bson.M{"$in": users}, "server_uuid": ""})
+	}
+
+	webhooks := []model.Webhook{}
+	if len(scopes) > 0 {
+		found := []model.Webhook{}
+		cur, err := a.mdb.Collection("webhooks").Find(a.ctx, bson.M{"active": true, "$or": scopes})
+		if err != nil {
+			return nil, err
+		}
+		defer cur.Close(a.ctx)
+		if err = cur.All(a.ctx, &found); err != nil {
+			return nil, err
+		}
+		webhooks = a.allowedWebhooks(found, server)
+	}
+
+	d.mu.Lock()
+	d.cache[key] = cachedWebhooks{webhooks: webhooks, expires: time.Now().Add(webhookCacheTTL)}
+	d.mu.Unlock()
+	return webhooks, nil
+}
+
+// serverUsers returns the emails of the users who can use a server.
+func (a API) serverUsers(server model.WebsocketServer) []string {
+	if server.OrgID == nil {
+		return []string{server.UserEmail}
+	}
+	org, err := a.findOrg(*server.OrgID)
+	if err != nil {
+		fmt.Println("Error finding organization of", server.UUID+":", err)
+		return nil
+	}
+	emails := []string{}
+	for _, member := range org.Members {
+		emails = append(emails, member.Email)
+	}
+	return emails
+}
+
+// allowedWebhooks leaves out the server webhooks of users who can no longer
+// use the server, since access is only checked when a webhook is created.
+func (a API) allowedWebhooks(webhooks []model.Webhook, server *model.WebsocketServer) []model.Webhook {
+	allowed := []model.Webhook{}
+	for _, webhook := range webhooks {
+		if webhook.ServerUUID != "" && (server == nil || !a.ownsServer(model.User{Email: webhook.UserEmail}, *server)) {
+			continue
+		}
+		allowed = append(allowed, webhook)
+	}
+	return allowed
+}
+
+// queueDeliveries saves a delivery of the event for every webhook that
+// subscribes to it, and reports whether there were any.
+func (a API) queueDeliveries(emitted emittedEvent) bool {
+	webhooks, err := a.subscribedWebhooks(emitted.owner, emitted.event.ServerUUID)
+	if err != nil {
+		fmt.Println("Error finding webhooks:", err)
+		return false
+	}
+
+	var payload []byte
+	deliveries := []interface{}{}
+	for _, webhook := range webhooks {
+		if !subscribesTo(webhook, emitted.event.Type) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(emitted.event); err != nil {
+				fmt.Println("Error marshalling webhook event:", err)
+				return false
+			}
+		}
+		deliveries = append(deliveries, newDelivery(webhook.ID, emitted.event.Type, string(payload)))
+	}
+	if len(deliveries) == 0 {
+		return false
+	}
+
+	if _, err = a.mdb.Collection("webhook_deliveries").InsertMany(a.ctx, deliveries); err != nil {
+		fmt.Println("Error queueing webhook deliveries:", err)
+		return false
+	}
+	return true
+}
+
+func subscribesTo(webhook model.Webhook, eventType string) bool {
+	for _, event := range webhook.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func newDelivery(webhookID primitive.ObjectID, event string, payload string) model.WebhookDelivery {
+	now := time.Now()
+	return model.WebhookDelivery{
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       payload,
+		Status:        model.DeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+}
+
+func (a API) deliverWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		a.deliverDue(ctx)
+		select {
+		case <-a.webhooks.wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverDue sends every delivery that is due, a few at a time.
+func (a API) deliverDue(ctx context.Context) {
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, webhookWorkers)
+	defer wg.Wait()
+
+	for ctx.Err() == nil {
+		workers <- struct{}{}
+		delivery, err := a.claimDelivery()
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				fmt.Println("Error claiming webhook delivery:", err)
+			}
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			a.attemptDelivery(delivery)
+		}()
+	}
+}
+
+// claimDelivery leases the next due delivery so no other worker, in this
+// process or another, sends it at the same time.
+func (a API) claimDelivery() (model.WebhookDelivery, error) {
+	now := time.Now()
+	filter := bson.M{"status": model.DeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(webhookLease)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).SetReturnDocument(options.After)
+
+	var delivery model.WebhookDelivery
+	err := a.mdb.Collection("webhook_deliveries").FindOneAndUpdate(a.ctx, filter, update, opts).Decode(&delivery)
+	return delivery, err
+}
+
+func (a API) attemptDelivery(delivery model.WebhookDelivery) {
+	var webhook model.Webhook
+	err := a.mdb.Collection("webhooks").FindOne(a.ctx, bson.D{{Key: "_id", Value: delivery.WebhookID}}).Decode(&webhook)
+	if err != nil || !webhook.Active {
+		a.settleDelivery(delivery, bson.M{"status": model.DeliveryFailed, "error": "Webhook was deleted or disabled."})
+		return
+	}
+
+	statusCode, err := a.sendWebhook(webhook, delivery)
+	attempts := delivery.Attempts + 1
+	set := bson.M{"attempts": attempts, "status_code": statusCode, "error": ""}
+	switch {
+	case err == nil:
+		now := time.Now()
+		set["status"] = model.DeliverySucceeded
+		set["delivered_at"] = now
+	case attempts >= webhookMaxAttempts:
+		set["status"] = model.DeliveryFailed
+		set["error"] = err.Error()
+	default:
+		set["next_attempt_at"] = time.Now().Add(backoff(attempts, webhookBaseBackoff, webhookMaxBackoff))
+		set["error"] = err.Error()
+	}
+	a.settleDelivery(delivery, set)
+}
+
+func (a API) settleDelivery(delivery model.WebhookDelivery, set bson.M) {
+	_, err := a.mdb.Collection("webhook_deliveries").UpdateOne(a.ctx, bson.D{{Key: "_id", Value: delivery.ID}}, bson.M{"$set": set})
+	if err != nil {
+		fmt.Println("Error updating webhook delivery:", err)
+	}
+}
+
+// sendWebhook posts a delivery to its webhook. Anything but a 2xx answer is
+// an error.
+func (a API) sendWebhook(webhook model.Webhook, delivery model.WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	payload := []byte(delivery.Payload)
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID.Hex())
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signPayload(webhook.Secret, timestamp, payload))
+
+	resp, err := a.webhooks.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("Endpoint answered " + resp.Status + ".")
+	}
+	return resp.StatusCode, nil
+}
+
+// signPayload signs the timestamp and payload of a request, so receivers can
+// check both where it came from and that it isn't a replay.
+func signPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/carlos-nunez/go-api-template/services"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const webhookDeliveryLimit = 100
+
+func validateWebhook(webhook model.Webhook) error {
+	endpoint, err := url.Parse(webhook.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Hostname() == "" {
+		return errors.New("Please enter an http or https URL.")
+	}
+	// Names are checked again when they are resolved for each delivery.
+	host := endpoint.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && !publicAddress(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateAddress
+	}
+
+	if len(webhook.Events) == 0 {
+		return errors.New("A webhook needs at least one event.")
+	}
+	for _, event := range webhook.Events {
+		known := false
+		for _, allowed := range model.WebhookEvents {
+			if event == allowed {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errors.New("Unknown event " + event + ".")
+		}
+	}
+
+	return nil
+}
+
+// getOwnedWebhook returns the webhook named in the route if it belongs to the
+// user making the request.
+func (a API) getOwnedWebhook(w http.ResponseWriter, r *http.Request) (model.Webhook, error) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		return model.Webhook{}, errors.New("User not found.")
+	}
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return model.Webhook{}, errors.New("Webhook not found.")
+	}
+
+	var webhook model.Webhook
+	err = a.mdb.Collection("webhooks").FindOne(a.ctx, bson.D{{Key: "_id", Value: id}}).Decode(&webhook)
+	if err != nil || webhook.UserEmail != user.Email {
+		return model.Webhook{}, errors.New("Webhook not found.")
+	}
+
+	return webhook, nil
+}
+
+func (a API) FetchWebhooks(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	webhooks := []model.Webhook{}
+	cur, err := a.mdb.Collection("webhooks").Find(a.ctx, bson.D{{Key: "user_email", Value: user.Email}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &webhooks); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	js, _ := json.Marshal(webhooks)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// CreateWebhook subscribes a URL to events of the user, or of one of their
+// servers. The response holds the signing secret, which isn't shown again.
+func (a API) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var webhook model.Webhook
+	err = a.marshallBody(&webhook, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err = validateWebhook(webhook); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if webhook.ServerUUID != "" {
+		server, err := a.GetWSServerByUUID(webhook.ServerUUID)
+		if err != nil || !a.ownsServer(user, server) {
+			http.Error(w, "Server not yours.", http.StatusForbidden)
+			return
+		}
+	}
+
+	secret, err := services.GenerateWSToken(32)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	webhook.ID = primitive.NilObjectID
+	webhook.UserEmail = user.Email
+	webhook.Secret = secret
+	webhook.Active = true
+	webhook.CreatedAt = time.Now()
+
+	result, err := a.mdb.Collection("webhooks").InsertOne(a.ctx, webhook)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	webhook.ID = result.InsertedID.(primitive.ObjectID)
+	a.webhooks.invalidate()
+
+	js, _ := json.Marshal(webhook)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// UpdateWebhook changes the URL, events or active flag of a webhook.
+func (a API) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := a.getOwnedWebhook(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var changes model.Webhook
+	err = a.marshallBody(&changes, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	webhook.URL = changes.URL
+	webhook.Events = changes.Events
+	webhook.Active = changes.Active
+	if err = validateWebhook(webhook); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{
+		"url":    webhook.URL,
+		"events": webhook.Events,
+		"active": webhook.Active,
+	}}
+	_, err = a.mdb.Collection("webhooks").UpdateOne(a.ctx, bson.D{{Key: "_id", Value: webhook.ID}}, update)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	a.webhooks.invalidate()
+
+	webhook.Secret = ""
+	js, _ := json.Marshal(webhook)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// DeleteWebhook removes a webhook along with its delivery log.
+func (a API) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := a.getOwnedWebhook(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	_, err = a.mdb.Collection("webhooks").DeleteOne(a.ctx, bson.D{{Key: "_id", Value: webhook.ID}})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	a.mdb.Collection("webhook_deliveries").DeleteMany(a.ctx, bson.D{{Key: "webhook_id", Value: webhook.ID}})
+	a.webhooks.invalidate()
+
+	js, _ := json.Marshal(webhook.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// FetchWebhookDeliveries returns the latest deliveries of a webhook, newest
+// first.
+func (a API) FetchWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhook, err := a.getOwnedWebhook(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	deliveries := []model.WebhookDelivery{}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(webhookDeliveryLimit)
+	cur, err := a.mdb.Collection("webhook_deliveries").Find(a.ctx, bson.D{{Key: "webhook_id", Value: webhook.ID}}, opts)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cur.Close(a.ctx)
+	if err = cur.All(a.ctx, &deliveries); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	js, _ := json.Marshal(deliveries)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// RedeliverWebhook sends the payload of an earlier delivery again, as a new
+// delivery with its own attempts.
+func (a API) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := a.getOwnedWebhook(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	deliveryID, err := primitive.ObjectIDFromHex(mux.Vars(r)["delivery"])
+	if err != nil {
+		http.Error(w, "Delivery not found.", 404)
+		return
+	}
+	var previous model.WebhookDelivery
+	err = a.mdb.Collection("webhook_deliveries").FindOne(a.ctx, bson.D{{Key: "_id", Value: deliveryID}, {Key: "webhook_id", Value: webhook.ID}}).Decode(&previous)
+	if err != nil {
+		http.Error(w, "Delivery not found.", 404)
+		return
+	}
+
+	delivery := newDelivery(webhook.ID, previous.Event, previous.Payload)
+	result, err := a.mdb.Collection("webhook_deliveries").InsertOne(a.ctx, delivery)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	delivery.ID = result.InsertedID.(primitive.ObjectID)
+	a.webhooks.notify()
+
+	js, _ := json.Marshal(delivery)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// deactivateServerWebhooks stops the webhooks of a server, when it is
+// deleted.
+func (a API) deactivateServerWebhooks(serverUUID string) error {
+	_, err := a.mdb.Collection("webhooks").UpdateMany(a.ctx, bson.M{"server_uuid": serverUUID}, bson.M{"$set": bson.M{"active": false}})
+	a.webhooks.invalidate()
+	return err
+}
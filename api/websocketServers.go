@@ -1,23 +1,44 @@
 package api
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/carlos-nunez/go-api-template/model"
-	"github.com/carlos-nunez/go-api-template/services"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-var DEPLOY_URL = os.Getenv("DEPLOY_URL")
+// userServerUUID is reserved for websocket connections authenticated with
+// user WS tokens.
+const userServerUUID = "api"
+
+// DEPLOY_KEY signs the callbacks of the deploy service.
 var DEPLOY_KEY = os.Getenv("DEPLOY_KEY")
 
+const maxReplicas = 10
+
+// serverCollections hold data of a server, keyed by its uuid.
+var serverCollections = []string{"api_keys", "server_configs", "rooms", "usage", "server_events", "webhooks", "deploy_jobs"}
+
+// clearServerData removes a deleted server and everything kept about it.
+func (a API) clearServerData(server model.WebsocketServer) error {
+	for _, collection := range serverCollections {
+		if _, err := a.mdb.Collection(collection).DeleteMany(a.ctx, bson.D{{Key: "server_uuid", Value: server.UUID}}); err != nil {
+			return err
+		}
+	}
+	_, err := a.mdb.Collection("servers").DeleteOne(a.ctx, bson.D{{Key: "_id", Value: server.ID}})
+	a.webhooks.invalidate()
+	return err
+}
+
 func (a API) CreateWebsocketServer(w http.ResponseWriter, r *http.Request) {
 	user, err := a.getUserByToken(w, r)
 
@@ -28,23 +49,72 @@ func (a API) CreateWebsocketServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiToken, err := services.GenerateApiToken()
+	if server.UUID == "" || server.UUID == userServerUUID {
+		http.Error(w, "Please choose another unique ID.", 400)
+		return
+	}
 
+	if err = validateServerConfig(server.Config); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if server.Replicas == 0 {
+		server.Replicas = 1
+	}
+	if server.Replicas < 1 || server.Replicas > maxReplicas {
+		http.Error(w, "replicas must be between 1 and 10.", 400)
+		return
+	}
+	if err = applyPlan(&server); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Servers created for an organization count towards its quota.
+	if server.OrgID != nil {
+		org, err := a.findOrg(*server.OrgID)
+		if err != nil || !canManage(orgRole(org, user.Email)) {
+			http.Error(w, "Only owners and admins of the organization can create its servers.", http.StatusForbidden)
+			return
+		}
+	}
+	usage, err := a.ownerUsage(user.Email, server.OrgID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	server.ApiToken = apiToken
+	if err = checkQuota(usage, serverUsage(server)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	server.ApiToken = ""
 	server.UserEmail = user.Email
-	server.Status = "Creating..."
+	server.Status = model.ServerPending
+	server.DesiredState = model.DesiredRunning
+	server.Error = ""
+	// Set by the deployment provider once the server is deployed.
+	server.Endpoint = ""
+	server.Region = ""
+	server.UpdatedAt = time.Now()
+	server.ConfigVersion = 1
 
 	var foundServer model.WebsocketServer
 	err = a.mdb.Collection("servers").FindOne(a.ctx, bson.D{{Key: "uuid", Value: server.UUID}}).Decode(&foundServer)
 
-	if err == nil {
+	if err == nil && foundServer.Status != model.ServerDeleted {
 		http.Error(w, "Server with this unique ID already exists. Please try another one.", 500)
 		return
 	}
+	if err == nil {
+		// The unique ID of a deleted server can be used again, once nothing
+		// of the old server is left for the new owner to see.
+		if err = a.clearServerData(foundServer); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
 
 	result, err := a.mdb.Collection("servers").InsertOne(a.ctx, server)
 
@@ -54,8 +124,22 @@ func (a API) CreateWebsocketServer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	server.ID = result.InsertedID.(primitive.ObjectID)
+	if err = a.recordConfigVersion(server, user.Email); err != nil {
+		fmt.Println("Error recording config version:", err)
+	}
 
-	a.sendDeployRequest(server)
+	// The server starts out with one key, shown only in this response.
+	apiKey, err := a.createApiKey(server.UUID, "default", nil)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	server.ApiToken = apiKey.Key
+
+	// The server is deployed in the background; its status follows along.
+	if err = a.enqueueDeployJob(server.UUID, model.DeployActionDeploy); err != nil {
+		fmt.Println("Error queueing deploy job:", err)
+	}
 
 	js, err := json.Marshal(server)
 
@@ -68,20 +152,36 @@ func (a API) DestroyWebsocketServer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	uuid := vars["uuid"]
 
-	var foundServer model.WebsocketServer
-	err = a.mdb.Collection("servers").FindOne(a.ctx, bson.D{{Key: "uuid", Value: uuid}}).Decode(&foundServer)
+	foundServer, err := a.GetWSServerByUUID(uuid)
 
 	if err != nil {
 		http.Error(w, "Server not found.", 500)
 		return
 	}
 
-	if foundServer.UserEmail != user.Email {
+	if !a.managesServer(user, foundServer) {
 		http.Error(w, "Server not yours, can't destroy.", 500)
 		return
 	}
 
-	a.sendDestroyRequest(foundServer)
+	foundServer, err = a.updateServerStatus(uuid, bson.M{
+		"desired_state": model.DesiredDeleted,
+		"status":        model.ServerDeleting,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// If this fails the reconciler queues the job later.
+	if err = a.enqueueDeployJob(uuid, model.DeployActionDestroy); err != nil {
+		fmt.Println("Error queueing deploy job:", err)
+	}
+	if err = a.revokeApiKeys(uuid); err != nil {
+		fmt.Println("Error revoking API keys:", err)
+	}
+	if err = a.deactivateServerWebhooks(uuid); err != nil {
+		fmt.Println("Error deactivating webhooks:", err)
+	}
 
 	js, err := json.Marshal(foundServer)
 
@@ -89,72 +189,258 @@ func (a API) DestroyWebsocketServer(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func (a API) sendDeployRequest(server model.WebsocketServer) (*http.Response, error) {
-	payload, err := json.Marshal(server)
-	fmt.Println("Creating a ws server.")
+// serverUpdate holds the fields of a server that can be changed. Fields
+// left out are kept.
+type serverUpdate struct {
+	Name      *string             `json:"name"`
+	Plan      *string             `json:"plan"`
+	Replicas  *int                `json:"replicas"`
+	Suspended *bool               `json:"suspended"`
+	Config    *model.ServerConfig `json:"config"`
+}
 
-	req, err := http.NewRequest("POST", DEPLOY_URL, bytes.NewBuffer(payload))
+// UpdateWebsocketServer renames a server, changes its plan, replicas or
+// configuration, or suspends and resumes it. Changes to what runs are rolled
+// out in the background, with the server Updating until they are done.
+func (a API) UpdateWebsocketServer(w http.ResponseWriter, r *http.Request) {
+	user, server, err := a.getRouteServer(w, r)
+	if err == nil && !a.managesServer(user, server) {
+		err = errors.New("Only owners and admins of the server can do this.")
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if server.DesiredState == model.DesiredDeleted {
+		http.Error(w, "Server is being deleted.", http.StatusConflict)
+		return
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+DEPLOY_KEY)
+	var update serverUpdate
+	if err = a.marshallBody(&update, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	updated := server
+	if update.Name != nil {
+		updated.Name = *update.Name
+	}
+	if update.Config != nil {
+		if err = validateServerConfig(*update.Config); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		updated.Config = *update.Config
+	}
+	if update.Replicas != nil {
+		if *update.Replicas < 1 || *update.Replicas > maxReplicas {
+			http.Error(w, "replicas must be between 1 and 10.", 400)
+			return
+		}
+		updated.Replicas = *update.Replicas
+	}
+	if update.Suspended != nil {
+		updated.DesiredState = model.DesiredRunning
+		if *update.Suspended {
+			updated.DesiredState = model.DesiredSuspended
+		}
+	}
+	if update.Plan != nil {
+		updated.Plan = *update.Plan
+	}
+	// Servers from before plans keep running without one until one is
+	// chosen.
+	if update.Plan != nil || (update.Config != nil && updated.Plan != "") {
+		if err = applyPlan(&updated); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	rescale := updated.Plan != server.Plan || updated.Instances() != server.Instances()
+	suspend := updated.DesiredState != server.DesiredState
+	deployed := server.Status == model.ServerRunning || server.Status == model.ServerUpdating || server.Status == model.ServerSuspended
+	if suspend && !deployed {
+		http.Error(w, "Only running servers can be suspended or resumed.", http.StatusConflict)
+		return
+	}
+
+	if rescale {
+		usage, err := a.ownerUsage(server.UserEmail, server.OrgID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		before, after := serverUsage(server), serverUsage(updated)
+		extra := model.Quota{CPU: after.CPU - before.CPU, Memory: after.Memory - before.Memory}
+		if err = checkQuota(usage, extra); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	set := bson.M{
+		"name":          updated.Name,
+		"plan":          updated.Plan,
+		"cpu":           updated.CPU,
+		"memory":        updated.Memory,
+		"replicas":      updated.Replicas,
+		"desired_state": updated.DesiredState,
+	}
+
+	// Servers that haven't been deployed yet, or failed to, are deployed
+	// again with the new plan. Running servers are scaled in place.
+	action := ""
+	switch {
+	case (rescale || suspend) && deployed:
+		action = model.DeployActionScale
+		set["status"] = model.ServerUpdating
+		set["error"] = ""
+	case rescale:
+		action = model.DeployActionDeploy
+		set["status"] = model.ServerPending
+		set["error"] = ""
+	}
+
+	// A new config is saved as a version of its own first, so a conflicting
+	// change leaves the rest of the server alone.
+	if update.Config != nil {
+		if _, err = a.saveServerConfig(server, updated.Config, user.Email); err == errConfigConflict {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	server, err = a.updateServerStatus(server.UUID, set)
 	if err != nil {
-		return nil, fmt.Errorf("Error sending request: %v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if action != "" {
+		// If this fails the reconciler queues the job later.
+		if err = a.enqueueDeployJob(server.UUID, action); err != nil {
+			fmt.Println("Error queueing deploy job:", err)
+		}
 	}
-	defer resp.Body.Close()
-	fmt.Println("Response Status:", resp.Status)
 
-	return resp, nil
+	server.ApiToken = ""
+	js, _ := json.Marshal(server)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
-func (a API) sendDestroyRequest(server model.WebsocketServer) (*http.Response, error) {
-	payload, err := json.Marshal(server)
+// serverRole returns the role of a user for a server: their role in the
+// organization that owns it, or owner of their personal servers.
+func (a API) serverRole(user model.User, server model.WebsocketServer) string {
+	if server.OrgID == nil {
+		if server.UserEmail == user.Email {
+			return model.OrgRoleOwner
+		}
+		return ""
+	}
 
-	req, err := http.NewRequest("DELETE", DEPLOY_URL, bytes.NewBuffer(payload))
+	org, err := a.findOrg(*server.OrgID)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+		return ""
 	}
+	return orgRole(org, user.Email)
+}
+
+// ownsServer reports whether the user can use the server.
+func (a API) ownsServer(user model.User, server model.WebsocketServer) bool {
+	return a.serverRole(user, server) != ""
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+DEPLOY_KEY)
+// managesServer reports whether the user can change or delete the server.
+func (a API) managesServer(user model.User, server model.WebsocketServer) bool {
+	return canManage(a.serverRole(user, server))
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// getOwnedServer returns the server named in the route if the user making
+// the request can use it.
+func (a API) getOwnedServer(w http.ResponseWriter, r *http.Request) (model.WebsocketServer, error) {
+	user, server, err := a.getRouteServer(w, r)
 	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
+		return server, err
 	}
-	defer resp.Body.Close()
 
-	fmt.Println("Response Status:", resp.Status)
+	if !a.ownsServer(user, server) {
+		return model.WebsocketServer{}, errors.New("Server not yours.")
+	}
 
-	return resp, nil
+	return server, nil
 }
 
-func (a API) GetWSServerByUUID(uuid string) (model.WebsocketServer, error) {
-	var server model.WebsocketServer
-	err := a.mdb.Collection("servers").FindOne(a.ctx, bson.D{{Key: "uuid", Value: uuid}}).Decode(&server)
-
+// getManagedServer returns the server named in the route if the user making
+// the request can change it.
+func (a API) getManagedServer(w http.ResponseWriter, r *http.Request) (model.WebsocketServer, error) {
+	user, server, err := a.getRouteServer(w, r)
 	if err != nil {
 		return server, err
 	}
 
+	if !a.managesServer(user, server) {
+		return model.WebsocketServer{}, errors.New("Only owners and admins of the server can do this.")
+	}
+
 	return server, nil
 }
 
-func (a API) GetWebsocketToken(token string) string {
+func (a API) getRouteServer(w http.ResponseWriter, r *http.Request) (model.User, model.WebsocketServer, error) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		return user, model.WebsocketServer{}, errors.New("User not found.")
+	}
+
+	server, err := a.GetWSServerByUUID(mux.Vars(r)["uuid"])
+	if err != nil {
+		return user, model.WebsocketServer{}, errors.New("Server not found.")
+	}
+
+	return user, server, nil
+}
+
+// FetchServerHub lists the rooms and connections of a server, along with its
+// message rates. Admins can inspect any server.
+func (a API) FetchServerHub(w http.ResponseWriter, r *http.Request) {
+	user, err := a.getUserByToken(w, r)
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusForbidden)
+		return
+	}
+
+	server, err := a.GetWSServerByUUID(mux.Vars(r)["uuid"])
+	if err != nil {
+		http.Error(w, "Server not found.", 404)
+		return
+	}
+	if !a.ownsServer(user, server) && user.Rank != "Admin" {
+		http.Error(w, "Server not yours.", http.StatusForbidden)
+		return
+	}
+	if a.realtime == nil {
+		http.Error(w, "Websockets are not running.", 500)
+		return
+	}
+
+	js, _ := json.Marshal(a.realtime.Inspect(server.UUID))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (a API) GetWSServerByUUID(uuid string) (model.WebsocketServer, error) {
 	var server model.WebsocketServer
-	err := a.mdb.Collection("servers").FindOne(a.ctx, bson.D{{Key: "token", Value: token}}).Decode(&server)
+	err := a.mdb.Collection("servers").FindOne(a.ctx, bson.D{{Key: "uuid", Value: uuid}, {Key: "status", Value: bson.M{"$ne": model.ServerDeleted}}}).Decode(&server)
 
 	if err != nil {
-		return ""
+		return server, err
 	}
 
-	return server.ApiToken
+	return server, nil
 }
 
 func (a API) FetchUserWebsocketServers(w http.ResponseWriter, r *http.Request) {
@@ -164,9 +450,23 @@ func (a API) FetchUserWebsocketServers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	orgIDs, err := a.userOrgIDs(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	var servers []model.WebsocketServer
 
-	cur, err := a.mdb.Collection("servers").Find(a.ctx, bson.D{{Key: "user_email", Value: user.Email}})
+	// Personal servers of the user and the servers of their organizations.
+	filter := bson.M{
+		"status": bson.M{"$ne": model.ServerDeleted},
+		"$or": bson.A{
+			bson.M{"user_email": user.Email, "org_id": nil},
+			bson.M{"org_id": bson.M{"$in": orgIDs}},
+		},
+	}
+	cur, err := a.mdb.Collection("servers").Find(a.ctx, filter)
 
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -183,3 +483,83 @@ func (a API) FetchUserWebsocketServers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
 }
+
+type transferRequest struct {
+	OrgID     *primitive.ObjectID `json:"org_id"`
+	UserEmail string              `json:"user_email"`
+}
+
+// TransferWebsocketServer moves a server to an organization the user
+// manages, or from an organization to one of its members. The server must
+// fit in the quota of its new owner.
+func (a API) TransferWebsocketServer(w http.ResponseWriter, r *http.Request) {
+	user, server, err := a.getRouteServer(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !a.managesServer(user, server) {
+		http.Error(w, "Only owners and admins of the server can transfer it.", http.StatusForbidden)
+		return
+	}
+
+	var request transferRequest
+	if err = a.marshallBody(&request, w, r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	set := bson.M{}
+	var unset bson.M
+	switch {
+	case request.OrgID != nil:
+		org, err := a.findOrg(*request.OrgID)
+		if err != nil || !canManage(orgRole(org, user.Email)) {
+			http.Error(w, "You can only transfer servers to organizations you own or administer.", http.StatusForbidden)
+			return
+		}
+		server.OrgID = request.OrgID
+		set["org_id"] = org.ID
+	case request.UserEmail != "":
+		if server.OrgID == nil {
+			http.Error(w, "Only servers of an organization can be transferred to a user.", 400)
+			return
+		}
+		org, err := a.findOrg(*server.OrgID)
+		if err != nil || orgRole(org, request.UserEmail) == "" {
+			http.Error(w, "Servers can only be transferred to members of their organization.", 400)
+			return
+		}
+		server.OrgID = nil
+		server.UserEmail = request.UserEmail
+		set["user_email"] = request.UserEmail
+		unset = bson.M{"org_id": ""}
+	default:
+		http.Error(w, "Please give an org_id or user_email to transfer the server to.", 400)
+		return
+	}
+
+	usage, err := a.ownerUsage(server.UserEmail, server.OrgID)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err = checkQuota(usage, serverUsage(server)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	update := bson.M{"$set": set}
+	if unset != nil {
+		update["$unset"] = unset
+	}
+	if _, err = a.mdb.Collection("servers").UpdateOne(a.ctx, bson.D{{Key: "_id", Value: server.ID}}, update); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	server.ApiToken = ""
+	js, _ := json.Marshal(server)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
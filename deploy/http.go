@@ -0,0 +1,171 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+// HTTPProvider drives a deploy service, such as the deploy template, over
+// HTTP. Servers are created with a POST, updated with a PUT and destroyed
+// with a DELETE of the server to the deploy URL. Status, scaling, logs and
+// config pushes are optional; services that don't implement them answer 404,
+// 405 or 501.
+type HTTPProvider struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func NewHTTPProvider(deployURL string, key string) *HTTPProvider {
+	return &HTTPProvider{
+		url:    deployURL,
+		key:    key,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *HTTPProvider) Create(server model.WebsocketServer) (Status, error) {
+	fmt.Println("Creating a ws server.")
+	return p.change("POST", p.url, server, model.ServerProvisioning, model.ServerRunning)
+}
+
+func (p *HTTPProvider) Destroy(server model.WebsocketServer) (Status, error) {
+	return p.change("DELETE", p.url, server, model.ServerDeleting, model.ServerDeleted)
+}
+
+func (p *HTTPProvider) Scale(server model.WebsocketServer, replicas int) (Status, error) {
+	server.Replicas = replicas
+	status, err := p.change("PUT", p.url, server, model.ServerUpdating, model.ServerRunning)
+	if err == nil && status.Replicas == 0 {
+		status.Replicas = replicas
+	}
+	return status, err
+}
+
+func (p *HTTPProvider) Status(server model.WebsocketServer) (Status, error) {
+	resp, err := p.send("GET", p.url+"?uuid="+url.QueryEscape(server.UUID), nil)
+	if err != nil {
+		return Status{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Status{}, ErrNotFound
+	}
+	if err = checkResponse(resp); err != nil {
+		return Status{}, err
+	}
+
+	var status Status
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return Status{}, fmt.Errorf("error reading status: %v", err)
+	}
+	return status, nil
+}
+
+func (p *HTTPProvider) Logs(server model.WebsocketServer, lines int) ([]string, error) {
+	resp, err := p.send("GET", p.url+"/logs?uuid="+url.QueryEscape(server.UUID)+"&lines="+strconv.Itoa(lines), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotSupported
+	}
+	if err = checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var logs []string
+	if err = json.NewDecoder(resp.Body).Decode(&logs); err != nil {
+		return nil, fmt.Errorf("error reading logs: %v", err)
+	}
+	return logs, nil
+}
+
+// Configure posts the server, with its new config, to {DEPLOY_URL}/config for
+// the service to hand on to its instances.
+func (p *HTTPProvider) Configure(server model.WebsocketServer) error {
+	payload, err := json.Marshal(server)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.send("POST", p.url+"/config", payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotSupported
+	}
+	return checkResponse(resp)
+}
+
+// change sends a request that changes a server. A 202 means the service
+// carries on in the background; any other 2xx that it is done. The service
+// may answer with a status to pass on the endpoint and region.
+func (p *HTTPProvider) change(method string, target string, body interface{}, pending string, done string) (Status, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return Status{}, err
+	}
+
+	resp, err := p.send(method, target, payload)
+	if err != nil {
+		return Status{}, err
+	}
+	defer resp.Body.Close()
+	fmt.Println("Response Status:", resp.Status)
+
+	if err = checkResponse(resp); err != nil {
+		return Status{}, err
+	}
+
+	var status Status
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1048576))
+	json.Unmarshal(data, &status)
+	status.State = done
+	if resp.StatusCode == http.StatusAccepted {
+		status.State = pending
+	}
+	return status, nil
+}
+
+func (p *HTTPProvider) send(method string, target string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.key)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	return resp, nil
+}
+
+// checkResponse turns answers other than 2xx into errors.
+func checkResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return ErrNotSupported
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("deploy service answered %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+const (
+	defaultLocalBasePort = 6000
+	localPortRange       = 1000
+	localLogLines        = 1000
+	localStopTimeout     = 30 * time.Second
+)
+
+// LocalProvider runs every server as child processes of this binary, each
+// listening on its own port with the server as its default uuid. Instances
+// don't run the background workers, which stay with the parent. It is meant
+// for trying out the full flow on one machine.
+type LocalProvider struct {
+	executable string
+	basePort   int
+
+	mu      sync.Mutex
+	servers map[string][]*process
+}
+
+// process is a running instance of a server.
+type process struct {
+	cmd  *exec.Cmd
+	port int
+	logs *logBuffer
+	// Closed once the process exits, after err is set.
+	done chan struct{}
+	err  error
+}
+
+// NewLocalProvider hands out ports from LOCAL_BASE_PORT, 6000 by default.
+func NewLocalProvider() (*LocalProvider, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	basePort := defaultLocalBasePort
+	if value := os.Getenv("LOCAL_BASE_PORT"); value != "" {
+		if basePort, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid LOCAL_BASE_PORT: %v", err)
+		}
+	}
+
+	return &LocalProvider{
+		executable: executable,
+		basePort:   basePort,
+		servers:    make(map[string][]*process),
+	}, nil
+}
+
+func (p *LocalProvider) Create(server model.WebsocketServer) (Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prune(server.UUID)
+	for len(p.servers[server.UUID]) < server.Instances() {
+		if err := p.start(server); err != nil {
+			return Status{}, err
+		}
+	}
+	return p.status(server.UUID)
+}
+
+func (p *LocalProvider) Destroy(server model.WebsocketServer) (Status, error) {
+	p.stop(server.UUID)
+	return Status{State: model.ServerDeleted}, nil
+}
+
+func (p *LocalProvider) Status(server model.WebsocketServer) (Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.status(server.UUID)
+}
+
+func (p *LocalProvider) Scale(server model.WebsocketServer, replicas int) (Status, error) {
+	if replicas < 0 {
+		return Status{}, errors.New("replicas can't be negative")
+	}
+	if replicas == 0 {
+		p.stop(server.UUID)
+		return Status{State: model.ServerSuspended}, nil
+	}
+
+	p.mu.Lock()
+	p.prune(server.UUID)
+	for len(p.servers[server.UUID]) < replicas {
+		if err := p.start(server); err != nil {
+			p.mu.Unlock()
+			return Status{}, err
+		}
+	}
+	processes := p.servers[server.UUID]
+	extra := processes[replicas:]
+	p.servers[server.UUID] = processes[:replicas]
+	p.mu.Unlock()
+
+	stopAll(extra)
+	return p.Status(server)
+}
+
+func (p *LocalProvider) Logs(server model.WebsocketServer, lines int) ([]string, error) {
+	p.mu.Lock()
+	processes := p.servers[server.UUID]
+	p.mu.Unlock()
+	if len(processes) == 0 {
+		return nil, ErrNotFound
+	}
+
+	logs := []string{}
+	for _, proc := range processes {
+		for _, line := range proc.logs.last(lines) {
+			logs = append(logs, fmt.Sprintf("[%d] %s", proc.port, line))
+		}
+	}
+	if len(logs) > lines {
+		logs = logs[len(logs)-lines:]
+	}
+	return logs, nil
+}
+
+// Configure sends SIGHUP to every instance of the server, which makes it
+// reload the server's config.
+func (p *LocalProvider) Configure(server model.WebsocketServer) error {
+	p.mu.Lock()
+	processes := p.servers[server.UUID]
+	p.mu.Unlock()
+	if len(processes) == 0 {
+		return ErrNotFound
+	}
+
+	for _, proc := range processes {
+		select {
+		case <-proc.done:
+		default:
+			proc.cmd.Process.Signal(syscall.SIGHUP)
+		}
+	}
+	return nil
+}
+
+// Stop ends every instance.
+func (p *LocalProvider) Stop() {
+	p.mu.Lock()
+	servers := p.servers
+	p.servers = make(map[string][]*process)
+	p.mu.Unlock()
+
+	for _, processes := range servers {
+		stopAll(processes)
+	}
+}
+
+// stop ends every instance of a server.
+func (p *LocalProvider) stop(uuid string) {
+	p.mu.Lock()
+	processes := p.servers[uuid]
+	delete(p.servers, uuid)
+	p.mu.Unlock()
+
+	stopAll(processes)
+}
+
+// status reports the server Running while any instance is, and Failed with
+// the last exit error once they have all exited.
+func (p *LocalProvider) status(uuid string) (Status, error) {
+	processes := p.servers[uuid]
+	if len(processes) == 0 {
+		return Status{}, ErrNotFound
+	}
+
+	status := Status{State: model.ServerFailed, Region: "local"}
+	for _, proc := range processes {
+		select {
+		case <-proc.done:
+			if proc.err != nil {
+				status.Error = proc.err.Error()
+			} else {
+				status.Error = "instance exited"
+			}
+		default:
+			if status.Replicas == 0 {
+				status.Endpoint = fmt.Sprintf("ws://localhost:%d/ws/%s", proc.port, uuid)
+			}
+			status.Replicas++
+		}
+	}
+	if status.Replicas > 0 {
+		status.State = model.ServerRunning
+		status.Error = ""
+	}
+	return status, nil
+}
+
+// prune forgets instances that have exited, so they are started again.
+func (p *LocalProvider) prune(uuid string) {
+	running := []*process{}
+	for _, proc := range p.servers[uuid] {
+		select {
+		case <-proc.done:
+		default:
+			running = append(running, proc)
+		}
+	}
+	p.servers[uuid] = running
+}
+
+func (p *LocalProvider) start(server model.WebsocketServer) error {
+	port, err := p.freePort()
+	if err != nil {
+		return err
+	}
+
+	logs := newLogBuffer(localLogLines)
+	cmd := exec.Command(p.executable)
+	cmd.Env = append(os.Environ(),
+		"uuid="+server.UUID,
+		"PORT="+strconv.Itoa(port),
+		"RUN_WORKERS=false",
+	)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("error starting instance: %v", err)
+	}
+	fmt.Println("Started local instance of", server.UUID, "on port", port)
+
+	proc := &process{cmd: cmd, port: port, logs: logs, done: make(chan struct{})}
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.done)
+	}()
+	p.servers[server.UUID] = append(p.servers[server.UUID], proc)
+	return nil
+}
+
+// freePort finds a port that no instance uses and nothing else listens on.
+func (p *LocalProvider) freePort() (int, error) {
+	used := make(map[int]bool)
+	for _, processes := range p.servers {
+		for _, proc := range processes {
+			used[proc.port] = true
+		}
+	}
+
+	for port := p.basePort; port < p.basePort+localPortRange; port++ {
+		if used[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		return port, nil
+	}
+	return 0, errors.New("no free port for a local instance")
+}
+
+// stopAll asks instances to shut down gracefully, and kills those that
+// haven't within the timeout.
+func stopAll(processes []*process) {
+	for _, proc := range processes {
+		proc.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	for _, proc := range processes {
+		select {
+		case <-proc.done:
+		case <-time.After(localStopTimeout):
+			proc.cmd.Process.Kill()
+			<-proc.done
+		}
+	}
+}
+
+// logBuffer keeps the last lines written by an instance.
+type logBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	limit   int
+	partial []byte
+}
+
+func newLogBuffer(limit int) *logBuffer {
+	return &logBuffer{limit: limit}
+}
+
+func (b *logBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.partial = append(b.partial, data...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.lines = append(b.lines, string(b.partial[:i]))
+		b.partial = b.partial[i+1:]
+	}
+	if len(b.lines) > b.limit {
+		b.lines = b.lines[len(b.lines)-b.limit:]
+	}
+	return len(data), nil
+}
+
+func (b *logBuffer) last(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n > len(b.lines) {
+		n = len(b.lines)
+	}
+	return append([]string(nil), b.lines[len(b.lines)-n:]...)
+}
@@ -0,0 +1,69 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+var (
+	// ErrNotSupported is returned by providers that can't perform an
+	// operation.
+	ErrNotSupported = errors.New("not supported by the deployment provider")
+	// ErrNotFound is returned when the provider isn't running the server.
+	ErrNotFound = errors.New("server not found by the deployment provider")
+)
+
+// Status is what a provider knows about a server. State is one of the
+// model server statuses.
+type Status struct {
+	State    string `json:"status"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Provider runs websocket servers somewhere.
+type Provider interface {
+	// Create deploys a server, or redeploys it if it exists. The status is
+	// Provisioning if the provider finishes in the background and reports
+	// back through the deployment callback.
+	Create(server model.WebsocketServer) (Status, error)
+	// Destroy tears a server down. The status is Deleting if the provider
+	// finishes in the background.
+	Destroy(server model.WebsocketServer) (Status, error)
+	// Status asks the provider how the server is doing.
+	Status(server model.WebsocketServer) (Status, error)
+	// Scale runs the given number of instances of the server, with its
+	// current plan. Zero replicas suspends it. The status is Updating if
+	// the provider finishes in the background.
+	Scale(server model.WebsocketServer, replicas int) (Status, error)
+	// Logs returns up to lines of the server's most recent output.
+	Logs(server model.WebsocketServer, lines int) ([]string, error)
+	// Configure tells the running instances of a server that its config
+	// changed, so they apply it to their open connections.
+	Configure(server model.WebsocketServer) error
+}
+
+// Stopper is implemented by providers that hold resources of their own,
+// such as child processes, to release on shutdown.
+type Stopper interface {
+	Stop()
+}
+
+// NewProvider returns the provider named by DEPLOY_PROVIDER: "http" (the
+// default) for a deploy service at DEPLOY_URL, or "local" to run servers as
+// child processes of this binary.
+func NewProvider() (Provider, error) {
+	switch name := os.Getenv("DEPLOY_PROVIDER"); name {
+	case "", "http":
+		return NewHTTPProvider(os.Getenv("DEPLOY_URL"), os.Getenv("DEPLOY_KEY")), nil
+	case "local":
+		return NewLocalProvider()
+	default:
+		return nil, fmt.Errorf("unknown deployment provider %q", name)
+	}
+}
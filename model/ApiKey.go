@@ -0,0 +1,54 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// API key scopes.
+const (
+	// Connect websockets and subscribe to rooms.
+	ScopeConnect = "connect"
+	// Publish messages over HTTP.
+	ScopePublish = "publish"
+	// Mint connection tickets.
+	ScopeTickets = "tickets"
+	// Connections ignore the access rules of rooms.
+	ScopeAdmin = "admin"
+)
+
+var ApiKeyScopes = []string{ScopeConnect, ScopePublish, ScopeTickets, ScopeAdmin}
+
+// Keys get these scopes unless limited. The admin scope has to be asked for.
+var DefaultApiKeyScopes = []string{ScopeConnect, ScopePublish, ScopeTickets}
+
+// ApiKey authenticates clients and backends of a websocket server. Only a
+// hash of the key is stored; the key itself is shown once, when it is
+// created.
+type ApiKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	ServerUUID string             `bson:"server_uuid" json:"server_uuid"`
+	Name       string             `bson:"name" json:"name"`
+	// The start of the key, to tell keys apart without revealing them. Keys
+	// migrated from plaintext tokens use the start of their hash.
+	Prefix     string     `bson:"prefix" json:"prefix"`
+	Hash       string     `bson:"hash" json:"-"`
+	Scopes     []string   `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	// Set on keys that were rotated, which keep working until then.
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	RevokedAt *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	// The key itself, only returned when it is created.
+	Key string `bson:"-" json:"key,omitempty"`
+}
+
+func (k ApiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package model
+
+import (
+	"github.com/golang-jwt/jwt"
+)
+
+// TicketRoom grants a connection ticket access to a room.
+type TicketRoom struct {
+	Room      string `json:"room"`
+	Publish   bool   `json:"publish"`
+	Subscribe bool   `json:"subscribe"`
+}
+
+// ConnectionTicketClaims are carried by a short-lived, single-use ticket
+// that lets a client connect to a websocket server without its API token.
+type ConnectionTicketClaims struct {
+	User   string       `json:"user"`
+	Server string       `json:"server"`
+	Rooms  []TicketRoom `json:"rooms"`
+	jwt.StandardClaims
+}
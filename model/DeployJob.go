@@ -0,0 +1,39 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Deploy job actions.
+const (
+	DeployActionDeploy  = "deploy"
+	DeployActionDestroy = "destroy"
+	// Applies a server's plan and replicas, or suspends and resumes it.
+	DeployActionScale = "scale"
+)
+
+// Deploy job statuses.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// DeployJob asks the deploy service to deploy, scale or destroy a server. A
+// server has at most one active job; a new one cancels the last.
+type DeployJob struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	ServerUUID    string             `bson:"server_uuid" json:"server_uuid"`
+	Action        string             `bson:"action" json:"action"`
+	Status        string             `bson:"status" json:"status"`
+	Active        bool               `bson:"active" json:"active"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	Error         string             `bson:"error" json:"error,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,53 @@
+package model
+
+// Message hook types.
+const (
+	HookProfanity   = "profanity"
+	HookStripFields = "strip_fields"
+	HookJSONSchema  = "json_schema"
+	HookEnrich      = "enrich"
+)
+
+// What a profanity hook does with a message containing a listed word.
+const (
+	ProfanityReject = "reject"
+	ProfanityMask   = "mask"
+	ProfanityDrop   = "drop"
+)
+
+// HookConfig configures one step of the hook chain messages pass through
+// before they are broadcast.
+type HookConfig struct {
+	Type string `bson:"type" json:"type"`
+	// Rooms the hook applies to, as globs such as chat-*. Empty applies to
+	// every room.
+	Rooms []string `bson:"rooms" json:"rooms,omitempty"`
+
+	// Profanity hooks.
+	Words  []string `bson:"words" json:"words,omitempty"`
+	Action string   `bson:"action" json:"action,omitempty"`
+
+	// Strip fields hooks. Nested fields are written as a.b.
+	Fields []string `bson:"fields" json:"fields,omitempty"`
+
+	// JSON schema hooks.
+	Schema *JSONSchema `bson:"schema" json:"schema,omitempty"`
+
+	// Enrich hooks add the sender under this field, "sender" by default.
+	Field string `bson:"field" json:"field,omitempty"`
+}
+
+// JSONSchema is the subset of JSON Schema messages can be validated against.
+type JSONSchema struct {
+	// object, array, string, number, integer, boolean or null.
+	Type                 string                 `bson:"type" json:"type,omitempty"`
+	Required             []string               `bson:"required" json:"required,omitempty"`
+	Properties           map[string]*JSONSchema `bson:"properties" json:"properties,omitempty"`
+	AdditionalProperties *bool                  `bson:"additional_properties" json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `bson:"items" json:"items,omitempty"`
+	Enum                 []interface{}          `bson:"enum" json:"enum,omitempty"`
+	MinLength            *int                   `bson:"min_length" json:"minLength,omitempty"`
+	MaxLength            *int                   `bson:"max_length" json:"maxLength,omitempty"`
+	Minimum              *float64               `bson:"minimum" json:"minimum,omitempty"`
+	Maximum              *float64               `bson:"maximum" json:"maximum,omitempty"`
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"time"
+)
+
+// ConnectionSnapshot describes a connection to a websocket server.
+type ConnectionSnapshot struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user,omitempty"`
+	IP          string    `json:"ip"`
+	Room        string    `json:"room,omitempty"`
+	Transport   string    `json:"transport"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Received    uint64    `json:"messages_received"`
+	Sent        uint64    `json:"messages_sent"`
+	Queued      int       `json:"queued"`
+	HighWater   int       `json:"queue_high_water"`
+	Dropped     uint64    `json:"messages_dropped"`
+}
+
+type RoomSnapshot struct {
+	Name        string `json:"name"`
+	Connections int    `json:"connections"`
+	// Sessions waiting for their client to reconnect.
+	Detached int `json:"detached_sessions"`
+}
+
+// MessageRates are messages per second over the last few seconds.
+type MessageRates struct {
+	Received  float64 `json:"received"`
+	Broadcast float64 `json:"broadcast"`
+	Sent      float64 `json:"sent"`
+	Dropped   float64 `json:"dropped"`
+}
+
+// ServerSnapshot is what the websocket hub holds for a server.
+type ServerSnapshot struct {
+	ServerUUID  string               `json:"server_uuid"`
+	Rooms       []RoomSnapshot       `json:"rooms"`
+	Connections []ConnectionSnapshot `json:"connections"`
+	Rates       MessageRates         `json:"rates"`
+}
@@ -0,0 +1,46 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Organization roles. Owners manage members and the organization itself,
+// admins manage its servers and invite people, and members use its servers
+// and tickets.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+type OrgMember struct {
+	Email    string    `bson:"email" json:"email"`
+	Role     string    `bson:"role" json:"role"`
+	JoinedAt time.Time `bson:"joined_at" json:"joined_at"`
+}
+
+// Organization owns servers and tickets on behalf of its members, so they
+// outlive any one member's account.
+type Organization struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Name      string             `bson:"name" json:"name"`
+	Members   []OrgMember        `bson:"members" json:"members"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	// Overrides the default quota for the organization's servers.
+	Quota *Quota `bson:"quota,omitempty" json:"quota,omitempty"`
+}
+
+// OrgInvitation lets the user with the email join an organization. It is
+// accepted by signing in with that email.
+type OrgInvitation struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	OrgID     primitive.ObjectID `bson:"org_id" json:"org_id"`
+	OrgName   string             `bson:"org_name" json:"org_name"`
+	Email     string             `bson:"email" json:"email"`
+	Role      string             `bson:"role" json:"role"`
+	InvitedBy string             `bson:"invited_by" json:"invited_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+}
@@ -0,0 +1,52 @@
+package model
+
+// Plan is a tier of websocket server. It sets the resources the server is
+// deployed with and the limits its hub enforces.
+type Plan struct {
+	Name string `json:"name"`
+	// CPU in millicores and memory in MiB.
+	CPU               int `json:"cpu"`
+	Memory            int `json:"memory"`
+	MaxConnections    int `json:"max_connections"`
+	MaxRooms          int `json:"max_rooms"`
+	MessagesPerMinute int `json:"messages_per_minute"`
+	// How long the server's event log is kept.
+	EventRetentionDays int `json:"event_retention_days"`
+}
+
+// DefaultPlan is used for servers created without one.
+const DefaultPlan = "free"
+
+var Plans = []Plan{
+	{Name: "free", CPU: 250, Memory: 256, MaxConnections: 100, MaxRooms: 10, MessagesPerMinute: 600, EventRetentionDays: 1},
+	{Name: "starter", CPU: 500, Memory: 512, MaxConnections: 1000, MaxRooms: 100, MessagesPerMinute: 3000, EventRetentionDays: 3},
+	{Name: "pro", CPU: 1000, Memory: 1024, MaxConnections: 10000, MaxRooms: 1000, MessagesPerMinute: 12000, EventRetentionDays: 7},
+	{Name: "business", CPU: 2000, Memory: 4096, MaxConnections: 50000, MaxRooms: 5000, MessagesPerMinute: 60000, EventRetentionDays: 30},
+}
+
+// FindPlan returns the plan with the given name.
+func FindPlan(name string) (Plan, bool) {
+	for _, plan := range Plans {
+		if plan.Name == name {
+			return plan, true
+		}
+	}
+	return Plan{}, false
+}
+
+// Quota caps what a user can run across all their servers. CPU is in
+// millicores and memory in MiB.
+type Quota struct {
+	MaxServers int `bson:"max_servers" json:"max_servers"`
+	CPU        int `bson:"cpu" json:"cpu"`
+	Memory     int `bson:"memory" json:"memory"`
+}
+
+// DefaultQuota applies to users without a quota of their own.
+var DefaultQuota = Quota{MaxServers: 3, CPU: 2000, Memory: 2048}
+
+// QuotaUsage is a user's quota next to what their servers use of it.
+type QuotaUsage struct {
+	Quota Quota `json:"quota"`
+	Used  Quota `json:"used"`
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Room roles. Readers may subscribe, writers may also publish.
+const (
+	RoomRoleRead  = "read"
+	RoomRoleWrite = "write"
+)
+
+type RoomMember struct {
+	// Identity is a user, or for patterns a glob such as *@example.com.
+	Identity string `bson:"identity" json:"identity"`
+	Role     string `bson:"role" json:"role"`
+}
+
+// Room holds the access rules of a websocket room. Rooms without one are
+// public and writable by everyone.
+type Room struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	ServerUUID string             `bson:"server_uuid" json:"server_uuid"`
+	Name       string             `bson:"name" json:"name"`
+	// Private rooms can only be joined by owners, members and identities
+	// matching a pattern.
+	Private  bool         `bson:"private" json:"private"`
+	Owners   []string     `bson:"owners" json:"owners"`
+	Members  []RoomMember `bson:"members" json:"members"`
+	Patterns []RoomMember `bson:"patterns" json:"patterns"`
+	// Role of everyone else in public rooms.
+	DefaultRole string    `bson:"default_role" json:"default_role"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Slow consumer policies, applied when a client's send buffer is full.
+const (
+	SlowConsumerDropOldest = "drop_oldest"
+	SlowConsumerDropNewest = "drop_newest"
+	SlowConsumerDisconnect = "disconnect"
+	SlowConsumerBlock      = "block"
+)
+
+// Keepalive timings used when a server doesn't set its own.
+const (
+	DefaultPingIntervalSeconds = 54
+	DefaultPongTimeoutSeconds  = 60
+	DefaultWriteTimeoutSeconds = 10
+)
+
+type ServerConfig struct {
+	SendBufferSize     int    `bson:"send_buffer_size" json:"send_buffer_size,omitempty"`
+	SlowConsumerPolicy string `bson:"slow_consumer_policy" json:"slow_consumer_policy,omitempty"`
+	BlockTimeoutMs     int    `bson:"block_timeout_ms" json:"block_timeout_ms,omitempty"`
+	MaxMessageSize     int64  `bson:"max_message_size" json:"max_message_size,omitempty"`
+	JoinMessages       bool   `bson:"join_messages" json:"join_messages,omitempty"`
+	Compression        bool   `bson:"compression" json:"compression,omitempty"`
+
+	// Origins allowed to connect, such as https://example.com or
+	// https://*.example.com. Empty allows every origin.
+	AllowedOrigins         []string `bson:"allowed_origins" json:"allowed_origins,omitempty"`
+	MaxConnectionsPerUser  int      `bson:"max_connections_per_user" json:"max_connections_per_user,omitempty"`
+	MaxConnectionsPerToken int      `bson:"max_connections_per_token" json:"max_connections_per_token,omitempty"`
+	MaxConnectionsPerIP    int      `bson:"max_connections_per_ip" json:"max_connections_per_ip,omitempty"`
+	// Connections and rooms the server allows in total, up to its plan's
+	// limits. Zero means the plan's limit.
+	MaxConnections int `bson:"max_connections" json:"max_connections,omitempty"`
+	MaxRooms       int `bson:"max_rooms" json:"max_rooms,omitempty"`
+	// New connections allowed per minute from a single IP.
+	ConnectionsPerMinute int `bson:"connections_per_minute" json:"connections_per_minute,omitempty"`
+
+	// How long a dropped client's session is kept for it to resume.
+	SessionGraceSeconds int `bson:"session_grace_seconds" json:"session_grace_seconds,omitempty"`
+
+	// Hooks messages pass through, in order, before they are broadcast.
+	Hooks []HookConfig `bson:"hooks" json:"hooks,omitempty"`
+
+	// Messages clients may send per minute from one connection, from all
+	// connections of one user, and into one room. Zero means no limit.
+	MessagesPerMinute     int `bson:"messages_per_minute" json:"messages_per_minute,omitempty"`
+	UserMessagesPerMinute int `bson:"user_messages_per_minute" json:"user_messages_per_minute,omitempty"`
+	RoomMessagesPerMinute int `bson:"room_messages_per_minute" json:"room_messages_per_minute,omitempty"`
+	// Messages that may be sent at once before the limits apply.
+	MessageBurst int `bson:"message_burst" json:"message_burst,omitempty"`
+	// Throttled messages a connection may send within a minute before it is
+	// disconnected. Zero never disconnects.
+	MaxRateViolations int `bson:"max_rate_violations" json:"max_rate_violations,omitempty"`
+
+	// How often connections are pinged, how long they may go without
+	// answering, and how long a write may take before they are closed.
+	PingIntervalSeconds int `bson:"ping_interval_seconds" json:"ping_interval_seconds,omitempty"`
+	PongTimeoutSeconds  int `bson:"pong_timeout_seconds" json:"pong_timeout_seconds,omitempty"`
+	WriteTimeoutSeconds int `bson:"write_timeout_seconds" json:"write_timeout_seconds,omitempty"`
+}
+
+// ServerConfigVersion is a saved version of the configuration of a server.
+// Every change adds a version.
+type ServerConfigVersion struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ServerUUID string             `bson:"server_uuid" json:"server_uuid"`
+	Version    int                `bson:"version" json:"version"`
+	Config     ServerConfig       `bson:"config" json:"config"`
+	UpdatedBy  string             `bson:"updated_by" json:"updated_by,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
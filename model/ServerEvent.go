@@ -0,0 +1,45 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Server event types, logged for the owners of a websocket server.
+const (
+	ServerEventConnected          = "connection.opened"
+	ServerEventDisconnected       = "connection.closed"
+	ServerEventRefused            = "connection.refused"
+	ServerEventAuthFailed         = "auth.failed"
+	ServerEventSubscriptionDenied = "subscription.denied"
+	ServerEventDeploy             = "deploy"
+	ServerEventError              = "error"
+	// Events over the log's rate limit are counted in one of these.
+	ServerEventsDropped = "events.dropped"
+)
+
+// Server event levels.
+const (
+	EventLevelInfo    = "info"
+	EventLevelWarning = "warning"
+	EventLevelError   = "error"
+)
+
+// ServerEvent is an entry in the event log of a websocket server.
+type ServerEvent struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ServerUUID   string             `bson:"server_uuid" json:"server_uuid"`
+	Type         string             `bson:"type" json:"type"`
+	Level        string             `bson:"level" json:"level"`
+	Message      string             `bson:"message" json:"message"`
+	ConnectionID string             `bson:"connection_id,omitempty" json:"connection_id,omitempty"`
+	IP           string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	User         string             `bson:"user,omitempty" json:"user,omitempty"`
+	Room         string             `bson:"room,omitempty" json:"room,omitempty"`
+	// Close code of refused connections.
+	Code      int       `bson:"code,omitempty" json:"code,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// Set from the plan of the server when the event is logged.
+	ExpiresAt time.Time `bson:"expires_at" json:"-"`
+}
@@ -25,4 +25,6 @@ type SupportTicket struct {
 	Product     string               `bson:"product" json:"product"`
 	Replies     []SupportTicketReply `bson:"replies" json:"replies"`
 	CreatedAt   time.Time            `bson:"created_at" json:"created_at"`
+	// Tickets filed for an organization are visible to all its members.
+	OrgID *primitive.ObjectID `bson:"org_id,omitempty" json:"org_id,omitempty"`
 }
@@ -0,0 +1,35 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Usage is what a websocket server used: the time its connections were
+// open, and the messages and bytes its clients sent and received.
+type Usage struct {
+	ConnectionSeconds int64 `bson:"connection_seconds" json:"connection_seconds"`
+	MessagesReceived  int64 `bson:"messages_received" json:"messages_received"`
+	MessagesSent      int64 `bson:"messages_sent" json:"messages_sent"`
+	BytesReceived     int64 `bson:"bytes_received" json:"bytes_received"`
+	BytesSent         int64 `bson:"bytes_sent" json:"bytes_sent"`
+}
+
+// UsageRecord is the usage of a server in one hour, summed over every
+// process that runs it.
+type UsageRecord struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ServerUUID string             `bson:"server_uuid" json:"server_uuid"`
+	Hour       time.Time          `bson:"hour" json:"hour"`
+	Usage      `bson:",inline"`
+}
+
+// UsageReport is the usage of a server over a time range.
+type UsageReport struct {
+	ServerUUID string        `json:"server_uuid"`
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Records    []UsageRecord `json:"records"`
+	Total      Usage         `json:"total"`
+}
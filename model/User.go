@@ -13,6 +13,8 @@ type User struct {
 	Token    string             `bson:"token" json:"token,omitempty"`
 	WS_Token string             `bson:"ws_token" json:"ws_token,omitempty"`
 	Rank     string             `bson:"rank" json:"rank,omitempty"`
+	// Overrides the default quota for this user's servers.
+	Quota *Quota `bson:"quota,omitempty" json:"quota,omitempty"`
 }
 
 type SignedClaims struct {
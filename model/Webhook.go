@@ -0,0 +1,64 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Webhook event types.
+const (
+	EventRoomMessage   = "room.message"
+	EventClientJoined  = "client.joined"
+	EventTicketCreated = "ticket.created"
+	EventTicketReply   = "ticket.reply"
+)
+
+var WebhookEvents = []string{EventRoomMessage, EventClientJoined, EventTicketCreated, EventTicketReply}
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook subscribes a URL to events. Webhooks of a server get the events of
+// that server; webhooks without one get every event of their user, including
+// those of the user's servers.
+type Webhook struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserEmail  string             `bson:"user_email" json:"user_email"`
+	ServerUUID string             `bson:"server_uuid" json:"server_uuid,omitempty"`
+	URL        string             `bson:"url" json:"url"`
+	Events     []string           `bson:"events" json:"events"`
+	Active     bool               `bson:"active" json:"active"`
+	// Secret signs deliveries. It is only returned when the webhook is created.
+	Secret    string    `bson:"secret" json:"secret,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// WebhookEvent is the body of a delivery.
+type WebhookEvent struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	ServerUUID string      `json:"server_uuid,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	Data       interface{} `json:"data"`
+}
+
+// WebhookDelivery is an attempt to deliver an event to a webhook, kept as a
+// log of what was sent and how the endpoint answered.
+type WebhookDelivery struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	WebhookID     primitive.ObjectID `bson:"webhook_id" json:"webhook_id"`
+	Event         string             `bson:"event" json:"event"`
+	Payload       string             `bson:"payload" json:"payload"`
+	Status        string             `bson:"status" json:"status"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	StatusCode    int                `bson:"status_code" json:"status_code,omitempty"`
+	Error         string             `bson:"error" json:"error,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	DeliveredAt   *time.Time         `bson:"delivered_at" json:"delivered_at,omitempty"`
+}
@@ -1,17 +1,65 @@
 package model
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Server statuses, as the server moves through provisioning and teardown.
+const (
+	ServerPending      = "Pending"
+	ServerProvisioning = "Provisioning"
+	ServerRunning      = "Running"
+	// A running server whose plan or replicas are being changed.
+	ServerUpdating  = "Updating"
+	ServerSuspended = "Suspended"
+	ServerFailed    = "Failed"
+	ServerDeleting  = "Deleting"
+	ServerDeleted   = "Deleted"
+)
+
+// Desired states of a server. The deploy workers and the reconciler move
+// the status towards it.
+const (
+	DesiredRunning   = "running"
+	DesiredSuspended = "suspended"
+	DesiredDeleted   = "deleted"
+)
+
 type WebsocketServer struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	Name      string             `bson:"name" json:"name"`
-	UUID      string             `bson:"uuid" json:"uuid"`
-	UserEmail string             `bson:"user_email" json:"user_email"`
-	CPU       string             `bson:"cpu" json:"cpu"`
-	Memory    string             `bson:"memory" json:"memory"`
-	Type      string             `bson:"type" json:"type"`
-	Status    string             `bson:"status" json:"status"`
-	ApiToken  string             `bson:"token" json:"token,omitempty"`
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Name         string             `bson:"name" json:"name"`
+	UUID         string             `bson:"uuid" json:"uuid"`
+	UserEmail    string             `bson:"user_email" json:"user_email"`
+	CPU          string             `bson:"cpu" json:"cpu"`
+	Memory       string             `bson:"memory" json:"memory"`
+	Type         string             `bson:"type" json:"type"`
+	Plan         string             `bson:"plan" json:"plan"`
+	Replicas     int                `bson:"replicas" json:"replicas"`
+	Status       string             `bson:"status" json:"status"`
+	DesiredState string             `bson:"desired_state" json:"desired_state"`
+	// Where the deploy service runs the server, once it reports it.
+	Endpoint string `bson:"endpoint" json:"endpoint,omitempty"`
+	Region   string `bson:"region" json:"region,omitempty"`
+	// Why the last deployment step failed, if it did.
+	Error     string    `bson:"error" json:"error,omitempty"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	// The first API key, only returned when the server is created. Servers
+	// from before API keys stored it here until it was migrated.
+	ApiToken string       `bson:"token,omitempty" json:"token,omitempty"`
+	Config   ServerConfig `bson:"config" json:"config"`
+	// Bumped every time the config changes.
+	ConfigVersion int `bson:"config_version" json:"config_version"`
+	// The organization that owns the server. Servers without one belong
+	// to the user who created them.
+	OrgID *primitive.ObjectID `bson:"org_id,omitempty" json:"org_id,omitempty"`
+}
+
+// Instances returns how many instances the server should run on.
+func (s WebsocketServer) Instances() int {
+	if s.Replicas < 1 {
+		return 1
+	}
+	return s.Replicas
 }
@@ -5,8 +5,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	API "github.com/carlos-nunez/go-api-template/api"
+	"github.com/carlos-nunez/go-api-template/deploy"
 	"github.com/carlos-nunez/go-api-template/middleware"
 	ws "github.com/carlos-nunez/go-api-template/ws"
 	"github.com/gorilla/handlers"
@@ -19,26 +25,78 @@ import (
 )
 
 var (
-	api    = API.NewAPI()
-	mdb    mongo.Database
-	router *mux.Router
-	ctx    context.Context
+	api         = API.NewAPI()
+	mdb         mongo.Database
+	mongoClient *mongo.Client
+	router      *mux.Router
+	ctx         context.Context
+	hub         *ws.Hub
+	// Stops the webhook and deploy workers on shutdown.
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+	// Stops the server event log once the hub has drained.
+	stopEventLog context.CancelFunc
+	eventLog     sync.WaitGroup
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func setupAPI() {
 	fetch := router.Methods("GET").PathPrefix("/api").Subrouter()
 	update := router.Methods("PUT").PathPrefix("/api").Subrouter()
 	create := router.Methods("POST").PathPrefix("/api").Subrouter()
 	delete := router.Methods("DELETE").PathPrefix("/api").Subrouter()
+	patch := router.Methods("PATCH").PathPrefix("/api").Subrouter()
 
 	create.HandleFunc("/users", api.CreateUser)
 	create.HandleFunc("/users/login", api.LoginUser)
 	fetch.HandleFunc("/users/regenerateToken", middleware.Auth(api.RegenerateWSToken))
 	fetch.HandleFunc("/users/current", middleware.Auth(api.FetchUserByToken))
+	fetch.HandleFunc("/users/quota", middleware.Auth(api.FetchQuota))
+	update.HandleFunc("/users/{email}/quota", middleware.Auth(api.UpdateUserQuota))
+	fetch.HandleFunc("/plans", api.FetchPlans)
 
 	fetch.HandleFunc("/servers", middleware.Auth(api.FetchUserWebsocketServers))
 	create.HandleFunc("/servers", middleware.Auth(api.CreateWebsocketServer))
 	delete.HandleFunc("/servers/{uuid}", middleware.Auth(api.DestroyWebsocketServer))
+	update.HandleFunc("/servers/{uuid}", middleware.Auth(api.UpdateWebsocketServer))
+	patch.HandleFunc("/servers/{uuid}", middleware.Auth(api.UpdateWebsocketServer))
+	create.HandleFunc("/servers/{uuid}/transfer", middleware.Auth(api.TransferWebsocketServer))
+	create.HandleFunc("/servers/{uuid}/messages", api.PublishRoomMessages)
+	create.HandleFunc("/servers/{uuid}/rooms/{room}/messages", api.PublishRoomMessage)
+	create.HandleFunc("/servers/{uuid}/connection-tickets", api.CreateConnectionTicket)
+	fetch.HandleFunc("/servers/{uuid}/rooms", middleware.Auth(api.FetchRooms))
+	fetch.HandleFunc("/servers/{uuid}/rooms/{room}", middleware.Auth(api.FetchRoom))
+	create.HandleFunc("/servers/{uuid}/rooms", middleware.Auth(api.CreateRoom))
+	update.HandleFunc("/servers/{uuid}/rooms/{room}", middleware.Auth(api.UpdateRoom))
+	delete.HandleFunc("/servers/{uuid}/rooms/{room}", middleware.Auth(api.DeleteRoom))
+	fetch.HandleFunc("/servers/{uuid}/hub", middleware.Auth(api.FetchServerHub))
+	fetch.HandleFunc("/servers/{uuid}/logs", middleware.Auth(api.FetchServerLogs))
+	fetch.HandleFunc("/servers/{uuid}/usage", middleware.Auth(api.FetchServerUsage))
+	fetch.HandleFunc("/servers/{uuid}/events", middleware.Auth(api.FetchServerEvents))
+	fetch.HandleFunc("/servers/{uuid}/events/stream", middleware.Auth(api.StreamServerEvents))
+	fetch.HandleFunc("/servers/{uuid}/config", middleware.Auth(api.FetchServerConfig))
+	update.HandleFunc("/servers/{uuid}/config", middleware.Auth(api.UpdateServerConfig))
+	fetch.HandleFunc("/servers/{uuid}/config/versions", middleware.Auth(api.FetchServerConfigVersions))
+	create.HandleFunc("/servers/{uuid}/config/versions/{version}/restore", middleware.Auth(api.RestoreServerConfig))
+	fetch.HandleFunc("/servers/{uuid}/keys", middleware.Auth(api.FetchApiKeys))
+	create.HandleFunc("/servers/{uuid}/keys", middleware.Auth(api.CreateApiKey))
+	create.HandleFunc("/servers/{uuid}/keys/{id}/rotate", middleware.Auth(api.RotateApiKey))
+	delete.HandleFunc("/servers/{uuid}/keys/{id}", middleware.Auth(api.RevokeApiKey))
+	create.HandleFunc("/deployments/callback", api.DeploymentCallback)
+
+	fetch.HandleFunc("/orgs", middleware.Auth(api.FetchOrganizations))
+	create.HandleFunc("/orgs", middleware.Auth(api.CreateOrganization))
+	fetch.HandleFunc("/orgs/{id}", middleware.Auth(api.FetchOrganization))
+	delete.HandleFunc("/orgs/{id}", middleware.Auth(api.DeleteOrganization))
+	fetch.HandleFunc("/orgs/{id}/quota", middleware.Auth(api.FetchOrganizationQuota))
+	fetch.HandleFunc("/orgs/{id}/invitations", middleware.Auth(api.FetchOrganizationInvitations))
+	create.HandleFunc("/orgs/{id}/invitations", middleware.Auth(api.InviteMember))
+	delete.HandleFunc("/orgs/{id}/invitations/{invitation}", middleware.Auth(api.DeleteInvitation))
+	update.HandleFunc("/orgs/{id}/members/{email}", middleware.Auth(api.UpdateMember))
+	delete.HandleFunc("/orgs/{id}/members/{email}", middleware.Auth(api.RemoveMember))
+	fetch.HandleFunc("/invitations", middleware.Auth(api.FetchInvitations))
+	create.HandleFunc("/invitations/{id}/accept", middleware.Auth(api.AcceptInvitation))
 
 	fetch.HandleFunc("/tickets", middleware.Auth(api.FetchSupportTickets))
 	fetch.HandleFunc("/tickets/all", middleware.Auth(api.FetchAllSupportTickets))
@@ -46,9 +104,24 @@ func setupAPI() {
 	update.HandleFunc("/tickets/{id}/reply", middleware.Auth(api.AddSupportReply))
 	update.HandleFunc("/tickets/{id}/status", middleware.Auth(api.UpdateTicketStatus))
 
+	fetch.HandleFunc("/webhooks", middleware.Auth(api.FetchWebhooks))
+	create.HandleFunc("/webhooks", middleware.Auth(api.CreateWebhook))
+	update.HandleFunc("/webhooks/{id}", middleware.Auth(api.UpdateWebhook))
+	delete.HandleFunc("/webhooks/{id}", middleware.Auth(api.DeleteWebhook))
+	fetch.HandleFunc("/webhooks/{id}/deliveries", middleware.Auth(api.FetchWebhookDeliveries))
+	create.HandleFunc("/webhooks/{id}/deliveries/{delivery}/redeliver", middleware.Auth(api.RedeliverWebhook))
+
 	fmt.Println("Finished Setting Up API")
 }
 
+func setupProvider() {
+	provider, err := deploy.NewProvider()
+	if err != nil {
+		panic(err)
+	}
+	api.SetProvider(provider)
+}
+
 func setupMongo() {
 	if err := godotenv.Load(); err != nil {
 		fmt.Println("No Env File")
@@ -67,6 +140,7 @@ func setupMongo() {
 		panic(err)
 	}
 
+	mongoClient = client
 	database := os.Getenv("PRODUCT")
 	db := client.Database(database)
 	mdb = *db
@@ -99,6 +173,175 @@ func setupIndexes(mdb mongo.Database, ctx context.Context) {
 	} else {
 		fmt.Println("Name of Index Created:", name2)
 	}
+
+	roomIndexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "server_uuid", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	name4, err := mdb.Collection("rooms").Indexes().CreateOne(ctx, roomIndexModel)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", name4)
+	}
+
+	// Redeemed connection tickets are only kept until the ticket expires.
+	ticketIndexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(60),
+	}
+
+	name3, err := mdb.Collection("redeemed_tickets").Indexes().CreateOne(ctx, ticketIndexModel)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", name3)
+	}
+
+	webhookIndexModel := mongo.IndexModel{
+		Keys: bson.D{{Key: "user_email", Value: 1}},
+	}
+
+	name5, err := mdb.Collection("webhooks").Indexes().CreateOne(ctx, webhookIndexModel)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", name5)
+	}
+
+	// Due deliveries are claimed by status and next attempt, and the log is
+	// listed per webhook and kept for 30 days.
+	deliveryIndexModels := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(30 * 24 * 60 * 60),
+		},
+	}
+
+	names, err := mdb.Collection("webhook_deliveries").Indexes().CreateMany(ctx, deliveryIndexModels)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", names)
+	}
+
+	// A server has at most one active deploy job, and due jobs are claimed
+	// by next attempt.
+	jobIndexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "server_uuid", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"active": true}),
+		},
+		{Keys: bson.D{{Key: "active", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+	}
+
+	jobNames, err := mdb.Collection("deploy_jobs").Indexes().CreateMany(ctx, jobIndexModels)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", jobNames)
+	}
+
+	// Keys are looked up by their hash, and listed per server.
+	keyIndexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "server_uuid", Value: 1}}},
+	}
+
+	keyNames, err := mdb.Collection("api_keys").Indexes().CreateMany(ctx, keyIndexModels)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", keyNames)
+	}
+
+	orgIndexModel := mongo.IndexModel{
+		Keys: bson.D{{Key: "members.email", Value: 1}},
+	}
+
+	orgName, err := mdb.Collection("organizations").Indexes().CreateOne(ctx, orgIndexModel)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", orgName)
+	}
+
+	// An email has one invitation per organization, listed by email, and
+	// invitations are removed once they expire.
+	invitationIndexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "org_id", Value: 1}, {Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+
+	invitationNames, err := mdb.Collection("org_invitations").Indexes().CreateMany(ctx, invitationIndexModels)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", invitationNames)
+	}
+
+	serverOrgIndexModel := mongo.IndexModel{
+		Keys: bson.D{{Key: "org_id", Value: 1}},
+	}
+
+	serverOrgName, err := mdb.Collection("servers").Indexes().CreateOne(ctx, serverOrgIndexModel)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", serverOrgName)
+	}
+
+	usageIndexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "server_uuid", Value: 1}, {Key: "hour", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	usageName, err := mdb.Collection("usage").Indexes().CreateOne(ctx, usageIndexModel)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", usageName)
+	}
+
+	configVersionIndexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "server_uuid", Value: 1}, {Key: "version", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	}
+
+	configVersionName, err := mdb.Collection("server_configs").Indexes().CreateOne(ctx, configVersionIndexModel)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", configVersionName)
+	}
+
+	serverEventIndexModels := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "server_uuid", Value: 1}, {Key: "_id", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+
+	serverEventNames, err := mdb.Collection("server_events").Indexes().CreateMany(ctx, serverEventIndexModels)
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+	} else {
+		fmt.Println("Name of Index Created:", serverEventNames)
+	}
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -117,10 +360,29 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 func setupWS() {
 	root := router.Methods("GET").Subrouter()
 	root.HandleFunc("/", serveHome)
-	hub := ws.NewHub(api)
+	// Metrics are only served to scrapers with the token.
+	if os.Getenv("METRICS_TOKEN") != "" {
+		root.HandleFunc("/metrics", ws.ServeMetrics)
+	}
+	hub = ws.NewHub(api)
 	go hub.Run()
-	router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	// Instances of a single server reload its config when signalled.
+	if uuid := os.Getenv("uuid"); uuid != "" {
+		go hub.ReloadConfigOnHangup(uuid)
+	}
+	serveWs := func(w http.ResponseWriter, r *http.Request) {
 		ws.ServeWs(hub, w, r)
+	}
+	router.HandleFunc("/ws", serveWs)
+	router.HandleFunc("/ws/{uuid}", serveWs)
+
+	serveSSE := func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeSSE(hub, w, r)
+	}
+	root.HandleFunc("/sse", serveSSE)
+	root.HandleFunc("/sse/{uuid}", serveSSE)
+	router.Methods("POST").Path("/sse/connections/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeSSEPublish(hub, w, r)
 	})
 }
 
@@ -129,15 +391,109 @@ func main() {
 
 	setupMongo()
 	api.Initialize(mdb, ctx)
-	setupAPI()
+	setupProvider()
+	// The hub registers itself with the api, so it must exist before the
+	// handlers are bound in setupAPI.
 	setupWS()
+	setupAPI()
 	setupIndexes(mdb, ctx)
+	api.MigrateApiTokens()
+
+	var eventLogCtx context.Context
+	eventLogCtx, stopEventLog = context.WithCancel(ctx)
+	eventLog.Add(1)
+	go func() {
+		defer eventLog.Done()
+		api.RunServerEvents(eventLogCtx)
+	}()
+
+	// Instances started by the local provider leave the workers to the
+	// process that started them.
+	if os.Getenv("RUN_WORKERS") != "false" {
+		var workerCtx context.Context
+		workerCtx, stopWorkers = context.WithCancel(ctx)
+		workers.Add(2)
+		go func() {
+			defer workers.Done()
+			api.RunWebhooks(workerCtx)
+		}()
+		go func() {
+			defer workers.Done()
+			api.RunDeployments(workerCtx)
+		}()
+	}
 
 	corsOrigins := handlers.AllowedOrigins([]string{"http://localhost:3000"})
-	corsMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE"})
+	corsMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE"})
 	corsHeaders := handlers.AllowedHeaders([]string{"Content-Type", "Authorization"})
 
 	corsHandler := handlers.CORS(corsOrigins, corsMethods, corsHeaders)(router)
 
-	http.ListenAndServe(":5000", corsHandler)
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "5000"
+	}
+
+	srv := &http.Server{Addr: ":" + port, Handler: corsHandler}
+	// Event streams and server-sent events connections would otherwise hold
+	// up the shutdown, so they are closed as soon as it starts.
+	srv.RegisterOnShutdown(api.CloseServerEventStreams)
+	srv.RegisterOnShutdown(hub.GoAway)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	shutdown(srv)
+}
+
+func shutdownTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || seconds <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func shutdown(srv *http.Server) {
+	fmt.Println("Shutting down")
+
+	// Stop accepting connections and let in-flight requests finish. Websockets
+	// are hijacked from the server, so the hub drains those itself.
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancelHTTP()
+	if err := srv.Shutdown(httpCtx); err != nil {
+		fmt.Println("Error shutting down HTTP server:", err)
+	}
+
+	// The hub was told to go away when the HTTP shutdown started, so its
+	// clients have been draining since. It gets its own timeout in case
+	// requests used up the HTTP one.
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancelDrain()
+	if err := hub.Shutdown(drainCtx); err != nil {
+		fmt.Println("Error draining websocket connections:", err)
+	}
+
+	// Closing connections logs events, so the log is written after.
+	stopEventLog()
+	eventLog.Wait()
+
+	if stopWorkers != nil {
+		stopWorkers()
+		workers.Wait()
+	}
+
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelDisconnect()
+	if err := mongoClient.Disconnect(disconnectCtx); err != nil {
+		fmt.Println("Error disconnecting from MongoDB:", err)
+	}
+
+	fmt.Println("Shutdown complete")
 }
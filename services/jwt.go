@@ -58,3 +58,35 @@ func ValidateToken(signedToken string) (claim *model.SignedClaims, msg string) {
 
 	return claims, msg
 }
+
+// ConnectionTicketAudience distinguishes connection tickets from login tokens,
+// which are signed with the same secret.
+const ConnectionTicketAudience = "ws-ticket"
+
+func GenerateConnectionTicket(claims model.ConnectionTicketClaims) (string, error) {
+	claims.Audience = ConnectionTicketAudience
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SIGNING_SECRET))
+}
+
+func ValidateConnectionTicket(signedTicket string) (*model.ConnectionTicketClaims, error) {
+	token, err := jwt.ParseWithClaims(
+		signedTicket,
+		&model.ConnectionTicketClaims{},
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method")
+			}
+			return []byte(SIGNING_SECRET), nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*model.ConnectionTicketClaims)
+	if !ok || !token.Valid || !claims.VerifyAudience(ConnectionTicketAudience, true) || claims.Id == "" || claims.Server == "" {
+		return nil, fmt.Errorf("the ticket is invalid")
+	}
+
+	return claims, nil
+}
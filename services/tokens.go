@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 )
 
 func GenerateWSToken(length int) (string, error) {
@@ -25,11 +26,26 @@ func GenerateWSToken(length int) (string, error) {
 	return token[:length], nil
 }
 
-func GenerateApiToken() (string, error) {
-	randomBytes := make([]byte, 32)
-	_, err := rand.Read(randomBytes)
-	hash := sha256.Sum256(randomBytes)
-	token := base64.URLEncoding.EncodeToString(hash[:])
+// GenerateApiKey returns a new server API key of the form
+// wsk_{prefix}_{secret}, along with its prefix.
+func GenerateApiKey() (prefix string, key string, err error) {
+	prefixBytes := make([]byte, 4)
+	if _, err = rand.Read(prefixBytes); err != nil {
+		return "", "", err
+	}
+	secretBytes := make([]byte, 32)
+	if _, err = rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+
+	prefix = hex.EncodeToString(prefixBytes)
+	key = "wsk_" + prefix + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+	return prefix, key, nil
+}
 
-	return token, err
+// HashApiKey hashes an API key for storage. Keys are long and random, so a
+// fast hash is enough and keeps lookups cheap.
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
 }
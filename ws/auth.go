@@ -0,0 +1,160 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/mux"
+)
+
+// userServer is the server id clients use to connect with their user WS
+// token instead of a server token.
+const userServer = "api"
+
+// requestedServer returns the server a connection is for, taken from the
+// path (/ws/{uuid}) or the server query parameter. Connections that name no
+// server go to the server of their ticket, or to the uuid env var of
+// single-tenant deployments.
+func requestedServer(r *http.Request) string {
+	if uuid := mux.Vars(r)["uuid"]; uuid != "" {
+		return uuid
+	}
+	return r.URL.Query().Get("server")
+}
+
+func loadServer(uuid string) (model.WebsocketServer, error) {
+	if uuid == userServer {
+		return model.WebsocketServer{UUID: userServer}, nil
+	}
+	return api.GetWSServerByUUID(uuid)
+}
+
+// credentials are what a token proved about a connection.
+type credentials struct {
+	// User behind the token. Only user WS tokens carry an identity; server
+	// keys are shared by every client of the server.
+	identity string
+	// Set for server keys with the admin scope, which ignore room rules.
+	admin bool
+}
+
+// authenticate checks a token against the credentials of a server.
+func authenticate(server model.WebsocketServer, apiToken string) (credentials, bool) {
+	if apiToken == "" {
+		return credentials{}, false
+	}
+
+	if server.UUID == userServer {
+		user, err := api.GetUserByWSToken(apiToken)
+		if err != nil {
+			return credentials{}, false
+		}
+		return credentials{identity: user.Email}, true
+	}
+
+	apiKey, err := api.AuthenticateApiKey(server.UUID, apiToken, model.ScopeConnect)
+	if err != nil {
+		return credentials{}, false
+	}
+	return credentials{admin: apiKey.HasScope(model.ScopeAdmin)}, true
+}
+
+// roomRoleTTL is how long a client remembers its role in a room before
+// checking the room's access rules again.
+const roomRoleTTL = 30 * time.Second
+
+type cachedRole struct {
+	role    string
+	expires time.Time
+}
+
+// roomRole returns the role of the client in a room, following the room's
+// access rules. Only called while handling an inbound message.
+func (c *Client) roomRole(room string) string {
+	// Every user has their own rooms on the user server, without rules.
+	if c.server.UUID == userServer {
+		return model.RoomRoleWrite
+	}
+	if cached, ok := c.roles[room]; ok && time.Now().Before(cached.expires) {
+		return cached.role
+	}
+
+	role, err := api.RoomRole(c.server.UUID, room, c.userEmail)
+	if err != nil {
+		log.Printf("error checking room access: %v", err)
+		return ""
+	}
+
+	if c.roles == nil {
+		c.roles = make(map[string]cachedRole)
+	}
+	c.roles[room] = cachedRole{role: role, expires: time.Now().Add(roomRoleTTL)}
+	return role
+}
+
+// messagePeers returns the users the client may message on the user server,
+// those it shares an organization with. Only called while handling an
+// inbound message.
+func (c *Client) messagePeers() map[string]bool {
+	if c.peers != nil && time.Now().Before(c.peersExpires) {
+		return c.peers
+	}
+
+	peers, err := api.OrgPeers(c.userEmail)
+	if err != nil {
+		log.Printf("error checking message peers: %v", err)
+		return c.peers
+	}
+	c.peers = peers
+	c.peersExpires = time.Now().Add(roomRoleTTL)
+	return peers
+}
+
+// canSubscribe reports whether the client may join a room. Clients without a
+// ticket prove access with a token.
+func (c *Client) canSubscribe(room string, token string) bool {
+	if c.grants == nil {
+		if _, ok := authenticate(c.server, token); !ok {
+			return false
+		}
+	}
+	return c.canJoin(room)
+}
+
+// canJoin reports whether the room's access rules let the client in, and its
+// ticket if it has one. Clients connected with an admin key ignore the rules.
+func (c *Client) canJoin(room string) bool {
+	if c.grants != nil {
+		grant, ok := c.grants[room]
+		if !ok || !grant.Subscribe {
+			return false
+		}
+	}
+	return c.admin || c.roomRole(room) != ""
+}
+
+func (c *Client) canPublish(room string) bool {
+	if c.grants != nil {
+		grant, ok := c.grants[room]
+		if !ok || !grant.Publish {
+			return false
+		}
+	}
+	return c.admin || c.roomRole(room) == model.RoomRoleWrite
+}
+
+// roomKey scopes a room name to the server of the client. Rooms of the user
+// server are also scoped to the token, since every user has their own. Ticket
+// clients use the token of their ticket's user.
+func (c *Client) roomKey(name string, token string) roomKey {
+	key := roomKey{Server: c.server.UUID, Name: name}
+	if c.grants != nil {
+		token = c.token
+	}
+	if c.server.UUID == userServer {
+		key.Token = token
+	}
+	return key
+}
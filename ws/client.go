@@ -3,28 +3,52 @@ package ws
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	API "github.com/carlos-nunez/go-api-template/api"
+	"github.com/carlos-nunez/go-api-template/model"
 	"github.com/gorilla/websocket"
 )
 
 const (
 	subscribeMessageType = "subscribe"
+	publishMessageType   = "publish"
+	directMessageType    = "direct"
+	errorMessageType     = "error"
+	shutdownMessageType  = "shutdown"
 )
 
 type subscribeMessage struct {
-	Type   string `json:"type"`
-	RoomID string `json:"roomID"`
-	Token  string `json:"token"` // Add this field
+	Type         string          `json:"type"`
+	RoomID       string          `json:"roomID"`
+	Token        string          `json:"token"` // Add this field
+	To           string          `json:"to,omitempty"`
+	ConnectionID string          `json:"connectionID,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	// Server whose event log to watch or unwatch.
+	Server string `json:"server,omitempty"`
+}
+
+type directEnvelope struct {
+	Type           string          `json:"type"`
+	From           string          `json:"from,omitempty"`
+	FromConnection string          `json:"fromConnection"`
+	Data           json.RawMessage `json:"data"`
+}
+
+type errorEnvelope struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
 }
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
+	// Used to refuse connections, before they have a config.
+	writeWait      = model.DefaultWriteTimeoutSeconds * time.Second
 	maxMessageSize = 512
 )
 
@@ -37,132 +61,365 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		// Allow all connections by returning true
+		// Origins are checked against the server's allowlist after the
+		// upgrade so refused clients get a close code explaining why.
 		return true
 	},
 }
 
 type Client struct {
-	hub           *Hub
-	roomID        roomKey
+	hub *Hub
+	// Connection id, used to address direct messages.
+	id string
+	// Email of the user behind the connection, if known.
+	userEmail string
+	// Token the connection authenticated with.
+	token string
+	// Address the connection came from.
+	ip string
+	// Server the connection belongs to.
+	server model.WebsocketServer
+	// Rooms a ticket grants access to, or nil for full access.
+	grants map[string]model.TicketRoom
+	// Set for connections with an admin key, which ignore room rules.
+	admin bool
+	// Roles of the client in the rooms it used. Guarded by the inbound lock.
+	roles map[string]cachedRole
+	// Users the client may message on the user server. Guarded by the
+	// inbound lock.
+	peers        map[string]bool
+	peersExpires time.Time
+	// Session the client asked to resume, and the room of that session if
+	// the client may still join it.
+	resumeID string
+	rejoin   string
+	// Session of the client. Owned by the hub.
+	session *session
+	// Set by readPump when the client closed the connection on purpose or
+	// was disconnected for misbehaving, so its session isn't kept.
+	leaving bool
+	// Message rate limit of the connection and how often it was exceeded
+	// recently. Owned by readPump.
+	limiter         *rateLimiter
+	violations      int
+	violationsSince time.Time
+	// Held while handling an inbound message. Server-sent events clients
+	// have no readPump; their messages arrive on concurrent requests.
+	inbound sync.Mutex
+	// Room the client last subscribed to. Owned by readPump.
+	roomID roomKey
+	// Room the hub has the client registered in. Owned by the hub.
+	room roomKey
+	// Metrics of the server, and of the connection itself.
+	metrics       *serverMetrics
+	connectedAt   time.Time
+	received      atomic.Uint64
+	sent          atomic.Uint64
 	conn          *websocket.Conn
-	send          chan []byte
+	send          *sendQueue
 	authenticated bool
+	// Config of the server, replaced by the hub when a new version is
+	// pushed.
+	config atomic.Pointer[runtimeConfig]
+	// Config the hooks and read limit were last set up from, and the hooks.
+	// Owned by readPump, or the inbound lock for server-sent events.
+	applied *runtimeConfig
+	hooks   []Hook
+	// Event logs the client watches, by server. Guarded by the inbound
+	// lock.
+	watches map[string]func()
 }
 
-func authenticate(apiToken string) bool {
-	uuid := os.Getenv("uuid")
-	isAuthenticated := false
-	if uuid == "api" {
-		_, err := api.GetUserByWSToken(apiToken)
-		if err == nil {
-			isAuthenticated = true
-		}
-	} else {
-		// fetch websocket server by uuid
-		server, err := api.GetWSServerByUUID(uuid)
-		if err != nil {
-			return false
-		}
-		if server.ApiToken == apiToken {
-			isAuthenticated = true
-		}
-	}
-	//otherwise use the api_key env variable
+func (c *Client) settings() *runtimeConfig {
+	return c.config.Load()
+}
 
-	return isAuthenticated
+// refreshConfig sets the connection up again if a new config was pushed
+// since the last message.
+func (c *Client) refreshConfig() {
+	config := c.settings()
+	if config == c.applied {
+		return
+	}
+	c.applied = config
+	c.hooks = buildHooks(config.Hooks)
+	if c.conn != nil {
+		c.conn.SetReadLimit(config.MaxMessageSize)
+	}
+}
 
+// resetPing moves ticker to the ping interval of the current config, if it
+// changed from interval, and returns the interval it ticks at.
+func (c *Client) resetPing(ticker *time.Ticker, interval time.Duration) time.Duration {
+	if current := c.settings().pingInterval(); current != interval {
+		ticker.Reset(current)
+		return current
+	}
+	return interval
 }
 
 func (c *Client) readPump() {
 	defer func() {
+		c.stopWatching()
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadDeadline(time.Now().Add(c.settings().pongTimeout()))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(c.settings().pongTimeout()))
+		return nil
+	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
+			c.leaving = websocket.IsCloseError(err, websocket.CloseNormalClosure)
 			break
 		}
+		c.countReceived(len(message))
 
+		c.inbound.Lock()
+		c.refreshConfig()
 		if c.authenticated {
-			var subMsg subscribeMessage
-			if err := json.Unmarshal(message, &subMsg); err == nil && subMsg.Type == subscribeMessageType {
-				// Authenticate the subscription message using the provided token
-				if authenticate(subMsg.Token) {
-					// Client is allowed to join the room
-					c.roomID = roomKey{Name: subMsg.RoomID + subMsg.Token, Token: subMsg.Token}
-					c.hub.register <- c
-				}
-			} else {
-				message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-				c.hub.broadcast <- messagePayload{roomID: c.roomID, data: message}
+			c.handleMessage(messageType, message)
+		}
+		leaving := c.leaving
+		c.inbound.Unlock()
+		if leaving {
+			break
+		}
+	}
+}
+
+func (c *Client) handleMessage(messageType int, message []byte) {
+	if messageType == websocket.BinaryMessage {
+		c.publish(c.roomID, message, true)
+		return
+	}
+
+	var subMsg subscribeMessage
+	err := json.Unmarshal(message, &subMsg)
+	switch {
+	case err == nil && subMsg.Type == subscribeMessageType:
+		c.subscribe(subMsg.RoomID, subMsg.Token)
+	case err == nil && subMsg.Type == publishMessageType:
+		c.publish(c.roomKey(subMsg.RoomID, c.token), API.MessageData(subMsg.Data), false)
+	case err == nil && subMsg.Type == directMessageType:
+		c.sendDirect(subMsg)
+	case err == nil && subMsg.Type == watchMessageType:
+		c.watch(subMsg.Server)
+	case err == nil && subMsg.Type == unwatchMessageType:
+		c.unwatch(subMsg.Server)
+	default:
+		c.publish(c.roomID, message, false)
+	}
+}
+
+func (c *Client) subscribe(room string, token string) {
+	// Authenticate the subscription message using the provided token
+	if !c.canSubscribe(room, token) {
+		c.sendError("Not allowed to subscribe to this room.")
+		c.logEvent(model.ServerEvent{Type: model.ServerEventSubscriptionDenied, Level: model.EventLevelWarning, Message: "Not allowed to subscribe to this room.", Room: room})
+		return
+	}
+	// Client is allowed to join the room
+	c.roomID = c.roomKey(room, token)
+	c.hub.register <- subscription{client: c, roomID: c.roomID}
+}
+
+// publish broadcasts a message from the client to a room after passing it
+// through the server's hooks.
+func (c *Client) publish(room roomKey, data []byte, binary bool) {
+	if room.Name == "" {
+		return
+	}
+	if !c.canPublish(room.Name) {
+		c.sendError("Not allowed to publish to this room.")
+		return
+	}
+	if !c.allowMessage(room.Name) {
+		c.throttle()
+		return
+	}
+
+	message := hookMessage{room: room.Name, data: data, binary: binary, sender: c}
+	if err := runHooks(c.hooks, &message); err != nil {
+		if rejection, ok := err.(Rejection); ok {
+			c.sendError(rejection.Reason)
+		} else if err != errDropMessage {
+			log.Printf("error running hooks: %v", err)
+			c.logEvent(model.ServerEvent{Type: model.ServerEventError, Level: model.EventLevelError, Message: "Error running hooks: " + err.Error(), Room: room.Name})
+		}
+		return
+	}
+	// Waiting for full clients with the block policy holds up this client's
+	// reads, pushing back on it.
+	result := make(chan deliveryResult, 1)
+	c.hub.broadcast <- messagePayload{roomID: room, data: message.data, binary: binary, result: result}
+	emitRoomMessage(c.server, message)
+	c.hub.wait(<-result, outbound{binary: binary, data: message.data})
+}
+
+func (c *Client) sendDirect(msg subscribeMessage) {
+	if msg.To == "" && msg.ConnectionID == "" {
+		c.sendError("Direct messages need a recipient.")
+		return
+	}
+	if !c.allowMessage("") {
+		c.throttle()
+		return
+	}
+	if msg.To != "" && c.userEmail == "" {
+		c.sendError("Only identified users can message other users.")
+		return
+	}
+
+	data, err := json.Marshal(directEnvelope{
+		Type:           directMessageType,
+		From:           c.userEmail,
+		FromConnection: c.id,
+		Data:           msg.Data,
+	})
+	if err != nil {
+		return
+	}
+
+	var peers map[string]bool
+	if c.server.UUID == userServer && c.userEmail != "" {
+		peers = c.messagePeers()
+		if msg.To != "" && msg.To != c.userEmail && !peers[msg.To] {
+			c.sendError("Not allowed to message this user.")
+			return
+		}
+	}
+
+	// Whether anyone got the message isn't reported, so clients can't tell
+	// who is online.
+	result := make(chan deliveryResult, 1)
+	c.hub.direct <- directMessage{from: c, peers: peers, toUser: msg.To, toConnection: msg.ConnectionID, data: data, result: result}
+	c.hub.wait(<-result, outbound{data: data})
+}
+
+// sendError queues an error frame for the client without blocking readPump.
+func (c *Client) sendError(text string) {
+	data, _ := json.Marshal(errorEnvelope{Type: errorMessageType, Error: text})
+	c.hub.direct <- directMessage{toConnection: c.id, data: data}
+}
+
+// writeMessages writes queued messages in order, each in its own frame.
+// Servers that join messages write consecutive text messages into one frame
+// separated by newlines instead, with the newlines inside them replaced by
+// spaces.
+func (c *Client) writeMessages(messages []outbound) error {
+	joinMessages := c.settings().JoinMessages
+	for len(messages) > 0 {
+		message := messages[0]
+		messages = messages[1:]
+
+		if message.binary {
+			if err := c.conn.WriteMessage(websocket.BinaryMessage, message.data); err != nil {
+				return err
 			}
+			c.countSent(message)
+			continue
+		}
+
+		if !joinMessages {
+			if err := c.conn.WriteMessage(websocket.TextMessage, message.data); err != nil {
+				return err
+			}
+			c.countSent(message)
+			continue
+		}
+
+		w, err := c.conn.NextWriter(websocket.TextMessage)
+		if err != nil {
+			return err
+		}
+		writeLine(w, message.data)
+		c.countSent(message)
+
+		for len(messages) > 0 && !messages[0].binary {
+			w.Write(newline)
+			writeLine(w, messages[0].data)
+			c.countSent(messages[0])
+			messages = messages[1:]
+		}
+
+		if err := w.Close(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// writeLine writes data with its newlines replaced by spaces, so it stays on
+// one line of a joined frame.
+func writeLine(w io.Writer, data []byte) {
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			w.Write(data)
+			return
+		}
+		w.Write(data[:i])
+		w.Write(space)
+		data = data[i+1:]
+	}
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	interval := c.settings().pingInterval()
+	ticker := time.NewTicker(interval)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.pumps.Done()
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-c.send.ready:
+			messages, open := c.send.drain()
+			c.conn.SetWriteDeadline(time.Now().Add(c.settings().writeTimeout()))
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if err := c.writeMessages(messages); err != nil {
 				return
 			}
-			w.Write(message)
 
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			if !open {
+				c.conn.WriteMessage(websocket.CloseMessage, c.send.closeMessage())
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.settings().writeTimeout()))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+			interval = c.resetPing(ticker, interval)
 		}
 	}
 }
 
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	// Extract the API token, e.g., using a query parameter "token"
-	apiToken := r.URL.Query().Get("token")
+	request := newConnectRequest(r)
+	connUpgrader := upgrader
+	connUpgrader.EnableCompression = request.config.Compression
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := connUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), authenticated: false}
 
-	// Authenticate the client using the API token
-	if authenticate(apiToken) {
-		client.authenticated = true
-		client.hub.authenticatedClients[client] = struct{}{}
+	// Refusals are sent as close frames so clients can tell why they were
+	// turned away.
+	client, reason := request.accept(hub, conn)
+	if reason != nil {
+		refuse(conn, *reason)
+		return
 	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -0,0 +1,126 @@
+package ws
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+const (
+	defaultSendBufferSize = 256
+	defaultBlockTimeoutMs = 5000
+	defaultSessionGrace   = 60
+	defaultMessageBurst   = 10
+)
+
+// serverConfig returns the runtime configuration of a websocket server with
+// defaults filled in and its plan's limits applied.
+func serverConfig(server model.WebsocketServer) model.ServerConfig {
+	config := server.Config
+
+	if plan, ok := model.FindPlan(server.Plan); ok {
+		config.MaxConnections = capLimit(config.MaxConnections, plan.MaxConnections)
+		config.MaxRooms = capLimit(config.MaxRooms, plan.MaxRooms)
+		config.MessagesPerMinute = capLimit(config.MessagesPerMinute, plan.MessagesPerMinute)
+	}
+
+	if config.SendBufferSize <= 0 {
+		config.SendBufferSize = defaultSendBufferSize
+	}
+	if config.SlowConsumerPolicy == "" {
+		config.SlowConsumerPolicy = model.SlowConsumerDisconnect
+	}
+	if config.BlockTimeoutMs <= 0 {
+		config.BlockTimeoutMs = defaultBlockTimeoutMs
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = maxMessageSize
+	}
+	if config.SessionGraceSeconds <= 0 {
+		config.SessionGraceSeconds = defaultSessionGrace
+	}
+	if config.MessageBurst <= 0 {
+		config.MessageBurst = defaultMessageBurst
+	}
+	if config.PingIntervalSeconds <= 0 {
+		config.PingIntervalSeconds = model.DefaultPingIntervalSeconds
+	}
+	if config.PongTimeoutSeconds <= 0 {
+		config.PongTimeoutSeconds = model.DefaultPongTimeoutSeconds
+	}
+	if config.WriteTimeoutSeconds <= 0 {
+		config.WriteTimeoutSeconds = model.DefaultWriteTimeoutSeconds
+	}
+
+	return config
+}
+
+// capLimit returns limit, or max if limit is unset or above it.
+func capLimit(limit int, max int) int {
+	if limit <= 0 || limit > max {
+		return max
+	}
+	return limit
+}
+
+// runtimeConfig is a version of the config of a server, with defaults filled
+// in, as applied to its connections.
+type runtimeConfig struct {
+	version int
+	model.ServerConfig
+}
+
+func (c *runtimeConfig) pingInterval() time.Duration {
+	return time.Duration(c.PingIntervalSeconds) * time.Second
+}
+
+func (c *runtimeConfig) pongTimeout() time.Duration {
+	return time.Duration(c.PongTimeoutSeconds) * time.Second
+}
+
+func (c *runtimeConfig) writeTimeout() time.Duration {
+	return time.Duration(c.WriteTimeoutSeconds) * time.Second
+}
+
+// ApplyConfig applies the config of a server to its open connections, unless
+// they already have that version or a newer one. Limits on connecting, such
+// as allowed origins, apply to new connections; send buffers keep their size
+// and policy.
+func (h *Hub) ApplyConfig(server model.WebsocketServer) {
+	h.reconfigure <- server
+}
+
+func (h *Hub) applyConfig(server model.WebsocketServer) {
+	config := &runtimeConfig{version: server.ConfigVersion, ServerConfig: serverConfig(server)}
+	for _, client := range h.clients {
+		if client.server.UUID == server.UUID && client.settings().version < config.version {
+			client.config.Store(config)
+		}
+	}
+}
+
+// ReloadConfigOnHangup loads the config of the server an instance runs
+// (named by the uuid env var) and reloads it, applying it to open
+// connections, whenever the process receives SIGHUP. The local provider
+// signals its instances this way.
+func (h *Hub) ReloadConfigOnHangup(uuid string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	if server, err := api.GetWSServerByUUID(uuid); err == nil {
+		log.Printf("serving %s with config version %d", uuid, server.ConfigVersion)
+	}
+	for range hangup {
+		server, err := api.GetWSServerByUUID(uuid)
+		if err != nil {
+			log.Printf("error reloading config: %v", err)
+			continue
+		}
+		log.Printf("applying config version %d of %s", server.ConfigVersion, uuid)
+		h.ApplyConfig(server)
+	}
+}
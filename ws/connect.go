@@ -0,0 +1,171 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/carlos-nunez/go-api-template/services"
+	"github.com/gorilla/websocket"
+)
+
+// connectRequest is a request for a new connection, over websockets or
+// server-sent events, resolved to the server it is for.
+type connectRequest struct {
+	r         *http.Request
+	ip        string
+	token     string
+	ticket    string
+	claims    *model.ConnectionTicketClaims
+	ticketErr error
+	server    model.WebsocketServer
+	serverErr error
+	config    model.ServerConfig
+	// Refuse clients that fail to authenticate rather than leaving them
+	// connected without access.
+	requireAuth bool
+}
+
+func newConnectRequest(r *http.Request) *connectRequest {
+	// Extract the API token, e.g., using a query parameter "token"
+	request := &connectRequest{
+		r:      r,
+		ip:     clientIP(r),
+		token:  r.URL.Query().Get("token"),
+		ticket: r.URL.Query().Get("ticket"),
+	}
+
+	uuid := requestedServer(r)
+	if request.ticket != "" {
+		request.claims, request.ticketErr = services.ValidateConnectionTicket(request.ticket)
+		if request.ticketErr == nil && uuid == "" {
+			uuid = request.claims.Server
+		}
+	}
+	if uuid == "" {
+		uuid = os.Getenv("uuid")
+	}
+
+	request.server, request.serverErr = loadServer(uuid)
+	request.config = serverConfig(request.server)
+	return request
+}
+
+// accept applies the server's connection policies, authenticates the client
+// and admits it to the hub. conn is nil for server-sent events.
+func (request *connectRequest) accept(hub *Hub, conn *websocket.Conn) (*Client, *refusal) {
+	client, reason := request.authorize(hub, conn)
+	if reason != nil {
+		metrics.refusal(reason.code)
+		eventType := model.ServerEventRefused
+		if reason.code == closeUnauthorized {
+			eventType = model.ServerEventAuthFailed
+		}
+		api.LogServerEvent(request.server, model.ServerEvent{Type: eventType, Level: model.EventLevelWarning, Message: reason.reason, IP: request.ip, Code: reason.code})
+		return nil, reason
+	}
+
+	transport := "websocket"
+	if conn == nil {
+		transport = "server-sent events"
+	}
+	client.logEvent(model.ServerEvent{Type: model.ServerEventConnected, Message: "Connected over " + transport + "."})
+	return client, nil
+}
+
+func (request *connectRequest) authorize(hub *Hub, conn *websocket.Conn) (*Client, *refusal) {
+	server, config := request.server, request.config
+
+	if request.serverErr != nil {
+		return nil, &refusal{code: closeUnknownServer, reason: "Unknown server."}
+	}
+	if !originAllowed(config, request.r.Header.Get("Origin")) {
+		return nil, &refusal{code: closeOriginNotAllowed, reason: "Origin not allowed."}
+	}
+	if !allowConnection(server.UUID, config, request.ip) {
+		return nil, &refusal{code: closeRateLimited, reason: "Too many connection attempts, try again later."}
+	}
+
+	if request.ticket != "" {
+		err := request.ticketErr
+		if err == nil && request.claims.Server != server.UUID {
+			err = errors.New("ticket is for another server")
+		}
+		if err == nil {
+			err = api.RedeemConnectionTicket(request.claims)
+		}
+		if err != nil {
+			return nil, &refusal{code: closeUnauthorized, reason: "Invalid or expired ticket."}
+		}
+	}
+
+	id, err := services.GenerateWSToken(16)
+	if err != nil {
+		log.Println(err)
+		return nil, &refusal{code: websocket.CloseInternalServerErr, reason: "Internal error."}
+	}
+	counters := metrics.server(server.UUID)
+	client := &Client{
+		hub:           hub,
+		id:            id,
+		ip:            request.ip,
+		server:        server,
+		conn:          conn,
+		metrics:       counters,
+		connectedAt:   time.Now(),
+		send:          newSendQueue(config, counters),
+		resumeID:      request.r.URL.Query().Get("session"),
+		authenticated: false,
+	}
+	client.config.Store(&runtimeConfig{version: server.ConfigVersion, ServerConfig: config})
+	client.refreshConfig()
+
+	// Authenticate the client using the ticket or the API token
+	if request.claims != nil {
+		// Rooms of the user server belong to the user's WS token, so ticket
+		// clients share them with the user's other connections.
+		if server.UUID == userServer {
+			user, err := api.GetUserByEmail(request.claims.User)
+			if err != nil {
+				return nil, &refusal{code: closeUnauthorized, reason: "Invalid or expired ticket."}
+			}
+			client.token = user.WS_Token
+		}
+		client.authenticated = true
+		client.userEmail = request.claims.User
+		client.grants = make(map[string]model.TicketRoom)
+		for _, room := range request.claims.Rooms {
+			client.grants[room.Room] = room
+		}
+	} else if creds, ok := authenticate(server, request.token); ok {
+		client.authenticated = true
+		client.token = request.token
+		client.userEmail = creds.identity
+		client.admin = creds.admin
+	} else if request.token != "" && !request.requireAuth {
+		api.LogServerEvent(server, model.ServerEvent{Type: model.ServerEventAuthFailed, Level: model.EventLevelWarning, Message: "Invalid token, connected without access.", IP: request.ip})
+	}
+
+	if request.requireAuth && !client.authenticated {
+		return nil, &refusal{code: closeUnauthorized, reason: "Authentication failed."}
+	}
+
+	// Rooms are checked like a subscribe before a session is resumed, since
+	// the client's access may have changed while it was away.
+	if client.resumeID != "" && client.authenticated {
+		if room := hub.sessionRoom(client.resumeID); room != "" && client.canJoin(room) {
+			client.rejoin = room
+		}
+	}
+
+	result := make(chan *refusal, 1)
+	hub.connect <- admission{client: client, result: result}
+	if reason := <-result; reason != nil {
+		return nil, reason
+	}
+
+	return client, nil
+}
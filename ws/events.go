@@ -0,0 +1,50 @@
+package ws
+
+import (
+	"encoding/base64"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+type roomMessageEvent struct {
+	Room string `json:"room"`
+	// Binary messages are base64 encoded.
+	Data   string `json:"data"`
+	Binary bool   `json:"binary,omitempty"`
+	Sender sender `json:"sender"`
+}
+
+type clientJoinedEvent struct {
+	Room         string `json:"room"`
+	ConnectionID string `json:"connectionID"`
+	User         string `json:"user,omitempty"`
+}
+
+// emitRoomMessage tells the webhooks of the server and of its current users
+// about a message broadcast to a room. Messages on the user server have no
+// owner to notify.
+func emitRoomMessage(server model.WebsocketServer, message hookMessage) {
+	if server.UUID == userServer {
+		return
+	}
+
+	event := roomMessageEvent{Room: message.room, Data: string(message.data), Binary: message.binary}
+	if message.binary {
+		event.Data = base64.StdEncoding.EncodeToString(message.data)
+	}
+	if message.sender == nil {
+		event.Sender = sender{Server: true}
+	} else {
+		event.Sender = sender{User: message.sender.userEmail, ConnectionID: message.sender.id}
+	}
+	api.EmitEvent("", server.UUID, model.EventRoomMessage, event)
+}
+
+func emitClientJoined(client *Client, room roomKey) {
+	if client.server.UUID == userServer {
+		return
+	}
+
+	event := clientJoinedEvent{Room: room.Name, ConnectionID: client.id, User: client.userEmail}
+	api.EmitEvent("", client.server.UUID, model.EventClientJoined, event)
+}
@@ -0,0 +1,367 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+// hookMessage is a message on its way to a room.
+type hookMessage struct {
+	room   string
+	data   []byte
+	binary bool
+	// Client that sent the message, or nil when published over HTTP.
+	sender *Client
+}
+
+// Hook inspects a message before it is broadcast. It may change the data,
+// or return a Rejection to refuse the message or errDropMessage to discard
+// it silently.
+type Hook interface {
+	Apply(message *hookMessage) error
+}
+
+// Rejection is returned when a hook refuses a message. The reason is sent
+// back to whoever published it.
+type Rejection struct {
+	Reason string
+}
+
+func (r Rejection) Error() string {
+	return r.Reason
+}
+
+var errDropMessage = errors.New("message dropped")
+
+// roomHook limits a hook to rooms matching a set of globs.
+type roomHook struct {
+	rooms []string
+	hook  Hook
+}
+
+func (h roomHook) Apply(message *hookMessage) error {
+	for _, pattern := range h.rooms {
+		if matched, _ := path.Match(pattern, message.room); matched {
+			return h.hook.Apply(message)
+		}
+	}
+	return nil
+}
+
+// buildHooks turns the hook configuration of a server into a chain. Unknown
+// hook types are skipped; the API validates configurations before saving.
+func buildHooks(configs []model.HookConfig) []Hook {
+	var hooks []Hook
+	for _, config := range configs {
+		var hook Hook
+		switch config.Type {
+		case model.HookProfanity:
+			hook = newProfanityHook(config)
+		case model.HookStripFields:
+			hook = stripFieldsHook{fields: config.Fields}
+		case model.HookJSONSchema:
+			hook = schemaHook{schema: config.Schema}
+		case model.HookEnrich:
+			hook = enrichHook{field: config.Field}
+		default:
+			continue
+		}
+
+		if len(config.Rooms) > 0 {
+			hook = roomHook{rooms: config.Rooms, hook: hook}
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// runHooks passes a text message through the chain. Binary messages are
+// broadcast as they are.
+func runHooks(hooks []Hook, message *hookMessage) error {
+	if message.binary {
+		return nil
+	}
+	for _, hook := range hooks {
+		if err := hook.Apply(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type profanityHook struct {
+	pattern *regexp.Regexp
+	action  string
+}
+
+func newProfanityHook(config model.HookConfig) Hook {
+	var words []string
+	for _, word := range config.Words {
+		if word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if len(words) == 0 {
+		return profanityHook{}
+	}
+
+	action := config.Action
+	if action == "" {
+		action = model.ProfanityReject
+	}
+	return profanityHook{
+		pattern: regexp.MustCompile(`(?i)(?:` + strings.Join(words, "|") + `)`),
+		action:  action,
+	}
+}
+
+func (h profanityHook) Apply(message *hookMessage) error {
+	if h.pattern == nil {
+		return nil
+	}
+	found := h.find(message.data)
+	if len(found) == 0 {
+		return nil
+	}
+
+	switch h.action {
+	case model.ProfanityMask:
+		// One asterisk per character, not per byte.
+		var masked []byte
+		last := 0
+		for _, loc := range found {
+			masked = append(masked, message.data[last:loc[0]]...)
+			masked = append(masked, strings.Repeat("*", utf8.RuneCount(message.data[loc[0]:loc[1]]))...)
+			last = loc[1]
+		}
+		message.data = append(masked, message.data[last:]...)
+		return nil
+	case model.ProfanityDrop:
+		return errDropMessage
+	default:
+		return Rejection{Reason: "Message contains blocked words."}
+	}
+}
+
+// find returns where the words appear in data as whole words. Word
+// boundaries are checked here rather than with \b, which only knows ASCII
+// letters and would match words inside words of other scripts.
+func (h profanityHook) find(data []byte) [][]int {
+	var found [][]int
+	for start := 0; start < len(data); {
+		loc := h.pattern.FindIndex(data[start:])
+		if loc == nil {
+			break
+		}
+		from, to := start+loc[0], start+loc[1]
+		if wordBoundary(data, from) && wordBoundary(data, to) {
+			found = append(found, []int{from, to})
+			start = to
+			continue
+		}
+		// A word may still start inside a match that wasn't whole.
+		_, size := utf8.DecodeRune(data[from:])
+		start = from + size
+	}
+	return found
+}
+
+// wordBoundary reports whether i is between a word character and something
+// else, in any script.
+func wordBoundary(data []byte, i int) bool {
+	before, _ := utf8.DecodeLastRune(data[:i])
+	after, _ := utf8.DecodeRune(data[i:])
+	return isWordRune(before) != isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// jsonObject decodes a message that is a JSON object, or returns nil.
+func jsonObject(data []byte) map[string]interface{} {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil
+	}
+	return object
+}
+
+type stripFieldsHook struct {
+	fields []string
+}
+
+func (h stripFieldsHook) Apply(message *hookMessage) error {
+	object := jsonObject(message.data)
+	if object == nil {
+		return nil
+	}
+
+	for _, field := range h.fields {
+		parts := strings.Split(field, ".")
+		parent := object
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := parent[part].(map[string]interface{})
+			if !ok {
+				parent = nil
+				break
+			}
+			parent = child
+		}
+		if parent != nil {
+			delete(parent, parts[len(parts)-1])
+		}
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	message.data = data
+	return nil
+}
+
+type enrichHook struct {
+	field string
+}
+
+type sender struct {
+	User         string `json:"user,omitempty"`
+	ConnectionID string `json:"connectionID,omitempty"`
+	Server       bool   `json:"server,omitempty"`
+}
+
+func (h enrichHook) Apply(message *hookMessage) error {
+	object := jsonObject(message.data)
+	if object == nil {
+		return nil
+	}
+
+	field := h.field
+	if field == "" {
+		field = "sender"
+	}
+	if message.sender == nil {
+		object[field] = sender{Server: true}
+	} else {
+		object[field] = sender{User: message.sender.userEmail, ConnectionID: message.sender.id}
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	message.data = data
+	return nil
+}
+
+type schemaHook struct {
+	schema *model.JSONSchema
+}
+
+func (h schemaHook) Apply(message *hookMessage) error {
+	if h.schema == nil {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(message.data, &value); err != nil {
+		return Rejection{Reason: "Message must be JSON."}
+	}
+	if err := validateSchema(h.schema, value, "message"); err != nil {
+		return Rejection{Reason: err.Error()}
+	}
+	return nil
+}
+
+func validateSchema(schema *model.JSONSchema, value interface{}, at string) error {
+	if schema == nil {
+		return nil
+	}
+
+	if schema.Type != "" && !schemaTypeMatches(schema.Type, value) {
+		return fmt.Errorf("%s must be of type %s.", at, schema.Type)
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not an allowed value.", at)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if schema.MinLength != nil && len([]rune(v)) < *schema.MinLength {
+			return fmt.Errorf("%s is too short.", at)
+		}
+		if schema.MaxLength != nil && len([]rune(v)) > *schema.MaxLength {
+			return fmt.Errorf("%s is too long.", at)
+		}
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			return fmt.Errorf("%s is too small.", at)
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			return fmt.Errorf("%s is too large.", at)
+		}
+	case []interface{}:
+		for i, item := range v {
+			if err := validateSchema(schema.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, field := range schema.Required {
+			if _, ok := v[field]; !ok {
+				return fmt.Errorf("%s.%s is required.", at, field)
+			}
+		}
+		for field, item := range v {
+			property, ok := schema.Properties[field]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not allowed.", at, field)
+				}
+				continue
+			}
+			if err := validateSchema(property, item, at+"."+field); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func schemaTypeMatches(schemaType string, value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return schemaType == "object"
+	case []interface{}:
+		return schemaType == "array"
+	case string:
+		return schemaType == "string"
+	case float64:
+		return schemaType == "number" || (schemaType == "integer" && v == float64(int64(v)))
+	case bool:
+		return schemaType == "boolean"
+	case nil:
+		return schemaType == "null"
+	}
+	return false
+}
@@ -1,17 +1,80 @@
 package ws
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
 	API "github.com/carlos-nunez/go-api-template/api"
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/websocket"
 )
 
 type messagePayload struct {
 	roomID roomKey
 	data   []byte
+	binary bool
+	result chan deliveryResult
+}
+
+// deliveryResult tells the sender of a message how many clients it was
+// queued for, and which clients with the block policy were full. The sender
+// waits for those with Hub.wait, off the hub's loop.
+type deliveryResult struct {
+	delivered int
+	blocked   []*Client
+}
+
+// outbound is a message queued for a client.
+type outbound struct {
+	binary bool
+	data   []byte
 }
 
 type roomKey struct {
-	Name  string
-	Token string
+	Server string
+	Name   string
+	Token  string
+}
+
+// admission asks the hub to accept a new connection. The hub answers on
+// result with nil, or with why the connection was refused.
+type admission struct {
+	client *Client
+	result chan *refusal
+}
+
+type clientLookup struct {
+	id        string
+	sessionID string
+	result    chan *Client
+}
+
+// inspection asks the hub for the rooms and connections of a server.
+type inspection struct {
+	server string
+	result chan model.ServerSnapshot
+}
+
+type subscription struct {
+	client *Client
+	roomID roomKey
+}
+
+// directMessage is addressed to a user (all of their connections) or to a
+// single connection. from is nil when the message originates on the server.
+// peers are the users from may message on the user server.
+type directMessage struct {
+	from         *Client
+	peers        map[string]bool
+	toUser       string
+	toConnection string
+	data         []byte
+	result       chan deliveryResult
 }
 
 type Hub struct {
@@ -20,67 +83,462 @@ type Hub struct {
 
 	authenticatedClients map[*Client]struct{}
 
+	// Connected clients by connection id.
+	clients map[string]*Client
+
+	// Connected clients by user email.
+	users map[string]map[*Client]struct{}
+
+	// Connection counts by token and by IP.
+	tokens map[string]int
+	ips    map[string]int
+
+	// Sessions by id, and detached sessions by the room they are in.
+	sessions map[string]*session
+	detached map[roomKey]map[*session]struct{}
+
 	// Inbound messages from the clients.
 	broadcast chan messagePayload
 
+	// Targeted messages from clients or the server.
+	direct chan directMessage
+
+	// New connections.
+	connect chan admission
+
 	// Register requests from the clients.
-	register chan *Client
+	register chan subscription
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Clients with the block policy that stayed full past their timeout.
+	evict chan *Client
+
+	// Requests to find a connection by id and session.
+	lookup chan clientLookup
+
+	// Requests for the rooms and connections of a server.
+	inspect chan inspection
+
+	// Requests for the room of a detached session.
+	sessionRooms chan sessionRoomQuery
+
+	// New configs of servers to apply to their connections.
+	reconfigure chan model.WebsocketServer
+
+	// Requests for the usage counters of every server.
+	usage chan chan map[string]usageTotals
+
+	// Serializes usage flushes.
+	meter usageMeter
+
+	// Shutdown requests, answered by closing the channel once every client
+	// has been told to go away.
+	shutdown chan chan struct{}
+
+	// Set once the hub is shutting down. Owned by Run.
+	closing bool
+
+	// Running writePumps, so shutdown can wait for them to flush.
+	pumps sync.WaitGroup
+}
+
+type shutdownNotice struct {
+	Type             string `json:"type"`
+	ReconnectAfterMs int    `json:"reconnectAfterMs"`
 }
 
+// Clients are asked to reconnect after a random delay within this window so
+// they don't all come back at once.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 10 * time.Second
+)
+
 var api *API.API
 
 func NewHub(apiRef *API.API) *Hub {
 	api = apiRef
-	return &Hub{
+	hub := &Hub{
 		broadcast:            make(chan messagePayload),
-		register:             make(chan *Client),
+		direct:               make(chan directMessage),
+		connect:              make(chan admission),
+		register:             make(chan subscription),
 		unregister:           make(chan *Client),
+		evict:                make(chan *Client),
+		lookup:               make(chan clientLookup),
+		inspect:              make(chan inspection),
+		sessionRooms:         make(chan sessionRoomQuery),
+		reconfigure:          make(chan model.WebsocketServer),
+		usage:                make(chan chan map[string]usageTotals),
+		shutdown:             make(chan chan struct{}),
 		rooms:                make(map[roomKey]map[*Client]struct{}),
 		authenticatedClients: make(map[*Client]struct{}),
+		clients:              make(map[string]*Client),
+		users:                make(map[string]map[*Client]struct{}),
+		tokens:               make(map[string]int),
+		ips:                  make(map[string]int),
+		sessions:             make(map[string]*session),
+		detached:             make(map[roomKey]map[*session]struct{}),
+		meter:                usageMeter{flushed: make(map[string]usageTotals)},
+	}
+	api.SetRealtime(hub)
+	return hub
+}
+
+// SendToUser delivers data to every connection authenticated as email.
+func (h *Hub) SendToUser(email string, data []byte) int {
+	result := make(chan deliveryResult, 1)
+	h.direct <- directMessage{toUser: email, data: data, result: result}
+	return h.wait(<-result, outbound{data: data})
+}
+
+// SendToConnection delivers data to the connection with the given id.
+func (h *Hub) SendToConnection(id string, data []byte) bool {
+	result := make(chan deliveryResult, 1)
+	h.direct <- directMessage{toConnection: id, data: data, result: result}
+	return h.wait(<-result, outbound{data: data}) > 0
+}
+
+// Publish passes data through the hooks of a server and broadcasts it to one
+// of its rooms. Messages the hooks reject return a Rejection.
+func (h *Hub) Publish(server model.WebsocketServer, room string, data []byte, binary bool) (int, error) {
+	message := hookMessage{room: room, data: data, binary: binary}
+	if err := runHooks(buildHooks(server.Config.Hooks), &message); err == errDropMessage {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	result := make(chan deliveryResult, 1)
+	h.broadcast <- messagePayload{roomID: roomKey{Server: server.UUID, Name: room}, data: message.data, binary: binary, result: result}
+	emitRoomMessage(server, message)
+	return h.wait(<-result, outbound{binary: binary, data: message.data}), nil
+}
+
+// wait queues a message for the clients that were full, holding up the
+// sender until they have room or their block timeout passes. Clients that
+// don't make room in time are disconnected. It returns how many clients the
+// message was queued for in all.
+func (h *Hub) wait(result deliveryResult, message outbound) int {
+	delivered := result.delivered
+	start := time.Now()
+	for _, client := range result.blocked {
+		switch client.send.pushWait(message, start.Add(client.send.timeout)) {
+		case pushQueued:
+			delivered++
+		case pushOverflow:
+			h.evict <- client
+		}
+	}
+	return delivered
+}
+
+// Inspect describes the rooms and connections of a server.
+func (h *Hub) Inspect(serverUUID string) model.ServerSnapshot {
+	result := make(chan model.ServerSnapshot, 1)
+	h.inspect <- inspection{server: serverUUID, result: result}
+	snapshot := <-result
+	snapshot.Rates = metrics.rates(serverUUID)
+	return snapshot
+}
+
+// GoAway tells every client the server is going away and closes their
+// queues, so they are sent a close frame once their queued messages are
+// written. New connections are refused. It may be called more than once.
+func (h *Hub) GoAway() {
+	done := make(chan struct{})
+	h.shutdown <- done
+	<-done
+}
+
+// Shutdown calls GoAway and waits for the connections to drain or for ctx to
+// expire.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.GoAway()
+
+	drained := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(drained)
+	}()
+
+	// Clients were removed when told to go away, so their connection time
+	// is final whether or not they drained.
+	defer h.flushUsage()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Hub) goAway() {
+	h.closing = true
+	for _, client := range h.clients {
+		delay := minReconnectDelay + time.Duration(rand.Int63n(int64(maxReconnectDelay-minReconnectDelay)))
+		notice, _ := json.Marshal(shutdownNotice{Type: shutdownMessageType, ReconnectAfterMs: int(delay / time.Millisecond)})
+		client.send.push(outbound{data: notice})
+		client.send.closeWith(websocket.CloseGoingAway, "Server shutting down, please reconnect.")
+		h.removeClient(client)
 	}
 }
 
+// canMessage reports whether the sender of a direct message may reach to.
+// Clients may only reach connections of the same server. Connections of the
+// user server belong to different users, so there the recipient must be the
+// sender, on another connection, or share an organization with them.
+func canMessage(message directMessage, to *Client) bool {
+	from := message.from
+	if from == nil {
+		return true
+	}
+	if !from.authenticated || !to.authenticated || from.server.UUID != to.server.UUID {
+		return false
+	}
+	if from.server.UUID != userServer {
+		return true
+	}
+	return from.userEmail != "" && (to.userEmail == from.userEmail || message.peers[to.userEmail])
+}
+
+func (h *Hub) removeClient(client *Client) {
+	if _, ok := h.clients[client.id]; !ok {
+		return
+	}
+	delete(h.clients, client.id)
+	delete(h.authenticatedClients, client)
+	client.metrics.connections.Add(-1)
+	client.metrics.connectedMs -= sinceEpoch(client.connectedAt)
+	client.metrics.closedMs += time.Since(client.connectedAt).Milliseconds()
+	decrement(h.tokens, client.token)
+	decrement(h.ips, client.ip)
+
+	if conns := h.users[client.userEmail]; conns != nil {
+		delete(conns, client)
+		if len(conns) == 0 {
+			delete(h.users, client.userEmail)
+		}
+	}
+
+	h.leaveRoom(client)
+	h.detachSession(client)
+	client.send.close()
+	client.logEvent(model.ServerEvent{Type: model.ServerEventDisconnected, Message: "Connection closed after " + time.Since(client.connectedAt).Round(time.Second).String() + "."})
+}
+
+// joinRoom moves a client into a room, unless opening the room would exceed
+// the room limit of its server.
+func (h *Hub) joinRoom(client *Client, key roomKey) bool {
+	maxRooms := client.settings().MaxRooms
+	if h.rooms[key] == nil && maxRooms > 0 && client.metrics.rooms.Load() >= int64(maxRooms) {
+		return false
+	}
+
+	h.leaveRoom(client)
+	client.room = key
+	if client.session != nil {
+		client.session.room = key
+	}
+
+	room := h.rooms[key]
+	if room == nil {
+		// First client in the room, create a new one
+		room = make(map[*Client]struct{})
+		h.rooms[key] = room
+		metrics.server(key.Server).rooms.Add(1)
+	}
+	room[client] = struct{}{}
+	return true
+}
+
+func decrement(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// admit registers a new connection unless it would exceed the connection
+// limits of its server.
+func (h *Hub) admit(client *Client) *refusal {
+	config := client.settings()
+	if h.closing {
+		return &refusal{code: websocket.CloseGoingAway, reason: "Server shutting down, please reconnect."}
+	}
+	if config.MaxConnections > 0 && client.metrics.connections.Load() >= int64(config.MaxConnections) {
+		return &refusal{code: closeTooManyConnections, reason: "Server is at its connection limit."}
+	}
+	if config.MaxConnectionsPerIP > 0 && h.ips[client.ip] >= config.MaxConnectionsPerIP {
+		return &refusal{code: closeTooManyConnections, reason: "Too many connections from this address."}
+	}
+	if client.token != "" && config.MaxConnectionsPerToken > 0 && h.tokens[client.token] >= config.MaxConnectionsPerToken {
+		return &refusal{code: closeTooManyConnections, reason: "Too many connections for this token."}
+	}
+	if client.userEmail != "" && config.MaxConnectionsPerUser > 0 && len(h.users[client.userEmail]) >= config.MaxConnectionsPerUser {
+		return &refusal{code: closeTooManyConnections, reason: "Too many connections for this user."}
+	}
+
+	h.clients[client.id] = client
+	h.ips[client.ip]++
+	if client.authenticated {
+		h.authenticatedClients[client] = struct{}{}
+		h.tokens[client.token]++
+	}
+	if client.userEmail != "" {
+		conns := h.users[client.userEmail]
+		if conns == nil {
+			conns = make(map[*Client]struct{})
+			h.users[client.userEmail] = conns
+		}
+		conns[client] = struct{}{}
+	}
+	h.startSession(client)
+	h.pumps.Add(1)
+	client.metrics.accepted.Add(1)
+	client.metrics.connections.Add(1)
+	client.metrics.connectedMs += sinceEpoch(client.connectedAt)
+	return nil
+}
+
+// findClient returns the connection with id if sessionID is its session,
+// which proves the caller owns the connection.
+func (h *Hub) findClient(id string, sessionID string) *Client {
+	client, ok := h.clients[id]
+	if !ok || client.session == nil || subtle.ConstantTimeCompare([]byte(client.session.id), []byte(sessionID)) != 1 {
+		return nil
+	}
+	return client
+}
+
+// deliver queues data for a client, disconnecting it if its policy says so.
+func (h *Hub) deliver(client *Client, message outbound) pushResult {
+	result := client.send.push(message)
+	if result == pushOverflow {
+		h.dropSlowClient(client)
+	}
+	return result
+}
+
+// deliverAll queues data for clients, leaving those that are full and block
+// to the sender.
+func (h *Hub) deliverAll(clients []*Client, message outbound) deliveryResult {
+	var result deliveryResult
+	for _, client := range clients {
+		switch h.deliver(client, message) {
+		case pushQueued:
+			result.delivered++
+		case pushFull:
+			result.blocked = append(result.blocked, client)
+		}
+	}
+	return result
+}
+
+func (h *Hub) dropSlowClient(client *Client) {
+	if _, ok := h.clients[client.id]; !ok {
+		return
+	}
+	log.Printf("disconnecting slow client %s", client.id)
+	client.metrics.slowConsumers.Add(1)
+	client.logEvent(model.ServerEvent{Type: model.ServerEventError, Level: model.EventLevelWarning, Message: "Disconnected a slow client whose send buffer overflowed."})
+	h.removeClient(client)
+}
+
+func (h *Hub) leaveRoom(client *Client) {
+	room := h.rooms[client.room]
+	if room == nil {
+		return
+	}
+	delete(room, client)
+	if len(room) == 0 {
+		// This was last client in the room, delete the room
+		delete(h.rooms, client.room)
+		metrics.server(client.room.Server).rooms.Add(-1)
+	}
+}
+
+func (h *Hub) deliverDirect(message directMessage) deliveryResult {
+	var targets []*Client
+	if message.toConnection != "" {
+		if client, ok := h.clients[message.toConnection]; ok {
+			targets = append(targets, client)
+		}
+	} else if message.toUser != "" {
+		for client := range h.users[message.toUser] {
+			targets = append(targets, client)
+		}
+	}
+
+	allowed := targets[:0]
+	for _, client := range targets {
+		if client != message.from && canMessage(message, client) {
+			allowed = append(allowed, client)
+		}
+	}
+	return h.deliverAll(allowed, outbound{data: message.data})
+}
+
 func (h *Hub) Run() {
+	sweep := time.NewTicker(sessionSweepInterval)
+	defer sweep.Stop()
+	go h.meterUsage()
+
 	for {
 		select {
-		case client := <-h.register:
-			room := h.rooms[client.roomID]
-			if room == nil {
-				// First client in the room, create a new one
-				room = make(map[*Client]struct{})
-				h.rooms[client.roomID] = room
+		case request := <-h.connect:
+			request.result <- h.admit(request.client)
+		case sub := <-h.register:
+			client := sub.client
+			if _, ok := h.clients[client.id]; !ok {
+				continue
+			}
+			if !h.joinRoom(client, sub.roomID) {
+				data, _ := json.Marshal(errorEnvelope{Type: errorMessageType, Error: "Server is at its room limit."})
+				h.deliver(client, outbound{data: data})
+				client.logEvent(model.ServerEvent{Type: model.ServerEventSubscriptionDenied, Level: model.EventLevelWarning, Message: "Server is at its room limit.", Room: sub.roomID.Name})
+				continue
 			}
-			room[client] = struct{}{}
+			emitClientJoined(client, sub.roomID)
 		case client := <-h.unregister:
-			room := h.rooms[client.roomID]
-			if room != nil {
-				if _, ok := room[client]; ok {
-					delete(room, client)
-					close(client.send)
-					if len(room) == 0 {
-						// This was last client in the room, delete the room
-						delete(h.rooms, client.roomID)
-					}
-				}
+			h.removeClient(client)
+		case client := <-h.evict:
+			h.dropSlowClient(client)
+		case <-sweep.C:
+			h.expireSessions()
+			metrics.sample()
+		case done := <-h.shutdown:
+			h.goAway()
+			close(done)
+		case request := <-h.lookup:
+			request.result <- h.findClient(request.id, request.sessionID)
+		case request := <-h.inspect:
+			request.result <- h.snapshot(request.server)
+		case request := <-h.sessionRooms:
+			request.result <- h.detachedRoom(request.id)
+		case server := <-h.reconfigure:
+			h.applyConfig(server)
+		case reply := <-h.usage:
+			reply <- metrics.usageTotals()
+		case message := <-h.direct:
+			result := h.deliverDirect(message)
+			if message.result != nil {
+				message.result <- result
 			}
 		case message := <-h.broadcast:
-			room := h.rooms[message.roomID]
-			if room != nil {
-				for client := range room {
-					select {
-					case client.send <- message.data:
-					default:
-						close(client.send)
-						delete(room, client)
-					}
-				}
-				if len(room) == 0 {
-					// The room was emptied while broadcasting to the room.  Delete the room.
-					delete(h.rooms, message.roomID)
-				}
+			metrics.server(message.roomID.Server).broadcast.Add(1)
+			clients := make([]*Client, 0, len(h.rooms[message.roomID]))
+			for client := range h.rooms[message.roomID] {
+				clients = append(clients, client)
+			}
+			data := outbound{binary: message.binary, data: message.data}
+			result := h.deliverAll(clients, data)
+			h.bufferForSessions(message.roomID, data)
+			if message.result != nil {
+				message.result <- result
 			}
 		}
 	}
@@ -0,0 +1,255 @@
+package ws
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+// serverMetrics counts what happens on a server. Counters are updated from
+// the hub and the pumps without locking.
+type serverMetrics struct {
+	connections atomic.Int64
+	rooms       atomic.Int64
+
+	accepted      atomic.Uint64
+	received      atomic.Uint64
+	receivedBytes atomic.Uint64
+	broadcast     atomic.Uint64
+	sent          atomic.Uint64
+	sentBytes     atomic.Uint64
+	dropped       atomic.Uint64
+	slowConsumers atomic.Uint64
+
+	// Counters at the last sample and the rates since. Guarded by the
+	// registry lock.
+	last  [4]uint64
+	rates model.MessageRates
+
+	// Milliseconds since meterEpoch: the sum of the connect times of open
+	// connections, and how long closed connections were open. Owned by the
+	// hub's Run loop.
+	connectedMs int64
+	closedMs    int64
+}
+
+// metricsRegistry holds the metrics of every server the hub has seen, and
+// refused connections by close code.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	servers    map[string]*serverMetrics
+	refused    map[int]uint64
+	lastSample time.Time
+}
+
+var metrics = &metricsRegistry{
+	servers: make(map[string]*serverMetrics),
+	refused: make(map[int]uint64),
+}
+
+func (m *metricsRegistry) server(uuid string) *serverMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	server := m.servers[uuid]
+	if server == nil {
+		server = &serverMetrics{}
+		m.servers[uuid] = server
+	}
+	return server
+}
+
+func (m *metricsRegistry) refusal(code int) {
+	m.mu.Lock()
+	m.refused[code]++
+	m.mu.Unlock()
+}
+
+// sample updates the message rates of every server. The hub calls it
+// periodically.
+func (m *metricsRegistry) sample() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(m.lastSample).Seconds()
+	for _, server := range m.servers {
+		current := [4]uint64{server.received.Load(), server.broadcast.Load(), server.sent.Load(), server.dropped.Load()}
+		if !m.lastSample.IsZero() && elapsed > 0 {
+			server.rates = model.MessageRates{
+				Received:  float64(current[0]-server.last[0]) / elapsed,
+				Broadcast: float64(current[1]-server.last[1]) / elapsed,
+				Sent:      float64(current[2]-server.last[2]) / elapsed,
+				Dropped:   float64(current[3]-server.last[3]) / elapsed,
+			}
+		}
+		server.last = current
+	}
+	m.lastSample = now
+}
+
+func (m *metricsRegistry) rates(uuid string) model.MessageRates {
+	server := m.server(uuid)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return server.rates
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	sample func(*serverMetrics) string
+}
+
+func counter(value *atomic.Uint64) string {
+	return strconv.FormatUint(value.Load(), 10)
+}
+
+var serverFamilies = []metricFamily{
+	{"ws_connections", "Open connections.", "gauge", func(s *serverMetrics) string { return strconv.FormatInt(s.connections.Load(), 10) }},
+	{"ws_rooms", "Rooms with at least one connection.", "gauge", func(s *serverMetrics) string { return strconv.FormatInt(s.rooms.Load(), 10) }},
+	{"ws_connections_accepted_total", "Connections accepted.", "counter", func(s *serverMetrics) string { return counter(&s.accepted) }},
+	{"ws_messages_received_total", "Messages received from clients.", "counter", func(s *serverMetrics) string { return counter(&s.received) }},
+	{"ws_received_bytes_total", "Bytes received from clients.", "counter", func(s *serverMetrics) string { return counter(&s.receivedBytes) }},
+	{"ws_messages_broadcast_total", "Messages broadcast to rooms.", "counter", func(s *serverMetrics) string { return counter(&s.broadcast) }},
+	{"ws_messages_sent_total", "Messages written to clients.", "counter", func(s *serverMetrics) string { return counter(&s.sent) }},
+	{"ws_sent_bytes_total", "Bytes written to clients.", "counter", func(s *serverMetrics) string { return counter(&s.sentBytes) }},
+	{"ws_messages_dropped_total", "Messages dropped because a send buffer was full.", "counter", func(s *serverMetrics) string { return counter(&s.dropped) }},
+	{"ws_slow_consumer_disconnects_total", "Connections closed because their send buffer overflowed.", "counter", func(s *serverMetrics) string { return counter(&s.slowConsumers) }},
+}
+
+// writeMetrics writes every metric in the Prometheus text format.
+func (m *metricsRegistry) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	uuids := make([]string, 0, len(m.servers))
+	servers := make(map[string]*serverMetrics, len(m.servers))
+	for uuid, server := range m.servers {
+		uuids = append(uuids, uuid)
+		servers[uuid] = server
+	}
+	codes := make([]int, 0, len(m.refused))
+	refused := make(map[int]uint64, len(m.refused))
+	for code, count := range m.refused {
+		codes = append(codes, code)
+		refused[code] = count
+	}
+	m.mu.Unlock()
+	sort.Strings(uuids)
+	sort.Ints(codes)
+
+	for _, family := range serverFamilies {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, uuid := range uuids {
+			fmt.Fprintf(w, "%s{server=\"%s\"} %s\n", family.name, escapeLabel(uuid), family.sample(servers[uuid]))
+		}
+	}
+
+	fmt.Fprint(w, "# HELP ws_connections_refused_total Connections refused, by close code.\n# TYPE ws_connections_refused_total counter\n")
+	for _, code := range codes {
+		fmt.Fprintf(w, "ws_connections_refused_total{code=\"%d\"} %d\n", code, refused[code])
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// ServeMetrics exposes the hub's metrics to Prometheus. Scrapers must send
+// METRICS_TOKEN as a bearer token; without one, metrics aren't served.
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("METRICS_TOKEN")
+	if token == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writeMetrics(w)
+}
+
+func (c *Client) countReceived(size int) {
+	c.received.Add(1)
+	c.metrics.received.Add(1)
+	c.metrics.receivedBytes.Add(uint64(size))
+}
+
+func (c *Client) countSent(message outbound) {
+	c.sent.Add(1)
+	c.metrics.sent.Add(1)
+	c.metrics.sentBytes.Add(uint64(len(message.data)))
+}
+
+func (h *Hub) snapshot(serverUUID string) model.ServerSnapshot {
+	snapshot := model.ServerSnapshot{
+		ServerUUID:  serverUUID,
+		Rooms:       []model.RoomSnapshot{},
+		Connections: []model.ConnectionSnapshot{},
+	}
+
+	rooms := make(map[string]*model.RoomSnapshot)
+	room := func(name string) *model.RoomSnapshot {
+		if rooms[name] == nil {
+			rooms[name] = &model.RoomSnapshot{Name: name}
+		}
+		return rooms[name]
+	}
+	for key, clients := range h.rooms {
+		if key.Server == serverUUID {
+			room(key.Name).Connections += len(clients)
+		}
+	}
+	for key, sessions := range h.detached {
+		if key.Server == serverUUID {
+			room(key.Name).Detached += len(sessions)
+		}
+	}
+	for _, r := range rooms {
+		snapshot.Rooms = append(snapshot.Rooms, *r)
+	}
+	sort.Slice(snapshot.Rooms, func(i, j int) bool { return snapshot.Rooms[i].Name < snapshot.Rooms[j].Name })
+
+	for _, client := range h.clients {
+		if client.server.UUID != serverUUID {
+			continue
+		}
+		transport := "websocket"
+		if client.conn == nil {
+			transport = "sse"
+		}
+		queue := client.send.stats()
+		snapshot.Connections = append(snapshot.Connections, model.ConnectionSnapshot{
+			ID:          client.id,
+			User:        client.userEmail,
+			IP:          client.ip,
+			Room:        client.room.Name,
+			Transport:   transport,
+			ConnectedAt: client.connectedAt,
+			Received:    client.received.Load(),
+			Sent:        client.sent.Load(),
+			Queued:      queue.Length,
+			HighWater:   queue.HighWater,
+			Dropped:     queue.Dropped,
+		})
+	}
+	sort.Slice(snapshot.Connections, func(i, j int) bool {
+		return snapshot.Connections[i].ConnectedAt.Before(snapshot.Connections[j].ConnectedAt)
+	})
+
+	return snapshot
+}
@@ -0,0 +1,159 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/websocket"
+)
+
+// Close codes sent when a connection is refused.
+const (
+	closeUnauthorized       = 4001
+	closeOriginNotAllowed   = 4003
+	closeUnknownServer      = 4004
+	closeTooManyConnections = 4008
+	closeRateLimited        = 4029
+)
+
+// refusal explains why a connection was not accepted.
+type refusal struct {
+	code   int
+	reason string
+}
+
+// connectionBurst is how many connections an IP may open at once before
+// connections_per_minute applies.
+const connectionBurst = 5
+
+var (
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*rateLimiter)
+)
+
+// sharedLimiter returns the limiter registered under name, replacing it if
+// the configured rate changed.
+func sharedLimiter(name string, perMinute int, burst int) *rateLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	limiter := limiters[name]
+	if limiter == nil || !limiter.limits(perMinute, burst) {
+		limiter = newRateLimiter(perMinute, burst)
+		limiters[name] = limiter
+	}
+	return limiter
+}
+
+// allowConnection applies the connection rate limit of a server to an IP.
+func allowConnection(server string, config model.ServerConfig, ip string) bool {
+	if config.ConnectionsPerMinute <= 0 {
+		return true
+	}
+	return sharedLimiter("connections:"+server, config.ConnectionsPerMinute, connectionBurst).allow(ip)
+}
+
+// allowMessage applies the message rate limits of the client's server to a
+// message it sends, to room if it is for one. The connection's limiter is
+// rebuilt when its rate or burst changes.
+func (c *Client) allowMessage(room string) bool {
+	config := c.applied
+	if config.MessagesPerMinute > 0 {
+		if c.limiter == nil || !c.limiter.limits(config.MessagesPerMinute, config.MessageBurst) {
+			c.limiter = newRateLimiter(config.MessagesPerMinute, config.MessageBurst)
+		}
+		if !c.limiter.allow("") {
+			return false
+		}
+	}
+	if config.UserMessagesPerMinute > 0 && c.userEmail != "" {
+		if !sharedLimiter("users:"+c.server.UUID, config.UserMessagesPerMinute, config.MessageBurst).allow(c.userEmail) {
+			return false
+		}
+	}
+	if config.RoomMessagesPerMinute > 0 && room != "" {
+		if !sharedLimiter("rooms:"+c.server.UUID, config.RoomMessagesPerMinute, config.MessageBurst).allow(room) {
+			return false
+		}
+	}
+	return true
+}
+
+// throttle tells the client it is sending too fast, and disconnects it once
+// it has been throttled more than its server allows within a minute.
+func (c *Client) throttle() {
+	now := time.Now()
+	if now.Sub(c.violationsSince) > time.Minute {
+		c.violations = 0
+		c.violationsSince = now
+	}
+	c.violations++
+
+	if max := c.settings().MaxRateViolations; max > 0 && c.violations > max {
+		// readPump stops once leaving is set and closes the connection.
+		c.leaving = true
+		c.logEvent(model.ServerEvent{Type: model.ServerEventError, Level: model.EventLevelWarning, Message: "Disconnected for exceeding the message rate limit.", Code: closeRateLimited})
+		if c.conn == nil {
+			c.send.closeWith(closeRateLimited, "Rate limit exceeded.")
+			return
+		}
+		message := websocket.FormatCloseMessage(closeRateLimited, "Rate limit exceeded.")
+		c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(c.settings().writeTimeout()))
+		return
+	}
+
+	c.sendError("Rate limit exceeded, slow down.")
+}
+
+// originAllowed checks the Origin header against the allowed origins.
+// Requests without an Origin header don't come from browsers and are allowed.
+func originAllowed(config model.ServerConfig, origin string) bool {
+	if len(config.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	for _, allowed := range config.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		// https://*.example.com matches any subdomain of example.com.
+		if i := strings.Index(allowed, "://*."); i >= 0 {
+			scheme, domain := allowed[:i+3], allowed[i+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) && len(origin) > len(scheme)+len(domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// trusted when TRUST_PROXY is set, since clients can send anything in it.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func refuse(conn *websocket.Conn, reason refusal) {
+	message := websocket.FormatCloseMessage(reason.code, reason.reason)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+	conn.Close()
+}
@@ -0,0 +1,207 @@
+package ws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+	"github.com/gorilla/websocket"
+)
+
+type pushResult int
+
+const (
+	// The message was queued for the client.
+	pushQueued pushResult = iota
+	// The queue was full and a message was dropped.
+	pushDropped
+	// The client can't keep up and must be disconnected.
+	pushOverflow
+	// The queue is full and the client's policy makes senders wait for it.
+	pushFull
+)
+
+// queueStats describes the outbound queue of a single connection.
+type queueStats struct {
+	Length    int
+	HighWater int
+	Dropped   uint64
+}
+
+// sendQueue buffers outbound messages for a client. Pushing never blocks, so
+// a slow consumer can't stall the hub; what happens when the buffer is full
+// depends on the policy. With the block policy, senders wait for room with
+// pushWait instead.
+type sendQueue struct {
+	mu       sync.Mutex
+	messages []outbound
+	capacity int
+	policy   string
+	timeout  time.Duration
+	closed   bool
+	// Close frame to send once the queue is drained.
+	closeCode   int
+	closeReason string
+	dropped     uint64
+	highWater   int
+	metrics     *serverMetrics
+
+	// ready is signalled whenever there is something for writePump to do.
+	ready chan struct{}
+	// space is closed, and replaced, whenever the queue is drained or
+	// closed, waking senders waiting for room.
+	space chan struct{}
+}
+
+func newSendQueue(config model.ServerConfig, metrics *serverMetrics) *sendQueue {
+	return &sendQueue{
+		capacity: config.SendBufferSize,
+		policy:   config.SlowConsumerPolicy,
+		timeout:  time.Duration(config.BlockTimeoutMs) * time.Millisecond,
+		metrics:  metrics,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}),
+	}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *sendQueue) push(message outbound) pushResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return pushOverflow
+	}
+
+	if len(q.messages) >= q.capacity {
+		switch q.policy {
+		case model.SlowConsumerDropNewest:
+			q.dropped++
+			q.metrics.dropped.Add(1)
+			return pushDropped
+		case model.SlowConsumerDropOldest:
+			// The incoming message is still queued, so this counts as a
+			// delivery even though an older message is lost.
+			q.messages = q.messages[1:]
+			q.dropped++
+			q.metrics.dropped.Add(1)
+		case model.SlowConsumerBlock:
+			return pushFull
+		default:
+			return pushOverflow
+		}
+	}
+
+	q.queue(message)
+	return pushQueued
+}
+
+// pushWait queues a message once there is room for it, waiting until the
+// deadline at most. It returns pushOverflow if there was no room in time, and
+// pushDropped if the queue was closed meanwhile.
+func (q *sendQueue) pushWait(message outbound, deadline time.Time) pushResult {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return pushDropped
+		}
+		if len(q.messages) < q.capacity {
+			q.queue(message)
+			q.mu.Unlock()
+			return pushQueued
+		}
+		space := q.space
+		q.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-timer.C:
+			return pushOverflow
+		}
+	}
+}
+
+// queue adds a message. The lock must be held.
+func (q *sendQueue) queue(message outbound) {
+	q.messages = append(q.messages, message)
+	if len(q.messages) > q.highWater {
+		q.highWater = len(q.messages)
+	}
+	q.signal()
+}
+
+// wakeSenders wakes the senders waiting for room. The lock must be held.
+func (q *sendQueue) wakeSenders() {
+	close(q.space)
+	q.space = make(chan struct{})
+}
+
+// drain takes every queued message. open is false once the queue is closed.
+func (q *sendQueue) drain() (messages []outbound, open bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages = q.messages
+	q.messages = nil
+	if len(messages) > 0 {
+		q.wakeSenders()
+	}
+
+	return messages, !q.closed
+}
+
+func (q *sendQueue) close() {
+	q.closeWith(0, "")
+}
+
+// closeWith closes the queue, asking writePump to send a close frame with
+// the code and reason after the queued messages.
+func (q *sendQueue) closeWith(code int, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.closeCode = code
+	q.closeReason = reason
+	q.signal()
+	q.wakeSenders()
+}
+
+func (q *sendQueue) closeStatus() (int, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.closeCode, q.closeReason
+}
+
+func (q *sendQueue) closeMessage() []byte {
+	code, reason := q.closeStatus()
+	if code == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(code, reason)
+}
+
+func (q *sendQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return queueStats{
+		Length:    len(q.messages),
+		HighWater: q.highWater,
+		Dropped:   q.dropped,
+	}
+}
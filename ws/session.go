@@ -0,0 +1,187 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/services"
+)
+
+const (
+	sessionMessageType   = "session"
+	sessionSweepInterval = 10 * time.Second
+)
+
+// session outlives a connection for a grace period, so a client that drops
+// can reconnect and pick up its room and the messages it missed.
+type session struct {
+	id        string
+	server    string
+	token     string
+	userEmail string
+	room      roomKey
+
+	// Connection using the session, or nil while detached.
+	client *Client
+	// Messages for the room while detached, at most limit of them.
+	pending []outbound
+	limit   int
+	grace   time.Duration
+	expires time.Time
+}
+
+// sessionRoomQuery asks the hub for the room of a detached session.
+type sessionRoomQuery struct {
+	id     string
+	result chan string
+}
+
+type sessionNotice struct {
+	Type         string `json:"type"`
+	SessionID    string `json:"sessionID"`
+	ConnectionID string `json:"connectionID"`
+	Resumed      bool   `json:"resumed"`
+}
+
+// startSession resumes the session the client asked for, or starts a new
+// one, and tells the client which it got.
+func (h *Hub) startSession(client *Client) {
+	s, resumed := h.resumeSession(client)
+	if !resumed {
+		id, err := services.GenerateWSToken(32)
+		if err != nil {
+			log.Printf("error starting session: %v", err)
+			return
+		}
+		s = &session{
+			id:        id,
+			server:    client.server.UUID,
+			token:     client.token,
+			userEmail: client.userEmail,
+			limit:     client.settings().SendBufferSize,
+			grace:     time.Duration(client.settings().SessionGraceSeconds) * time.Second,
+		}
+		h.sessions[id] = s
+	}
+	s.client = client
+	client.session = s
+
+	notice, _ := json.Marshal(sessionNotice{Type: sessionMessageType, SessionID: s.id, ConnectionID: client.id, Resumed: resumed})
+	client.send.push(outbound{data: notice})
+
+	if !resumed {
+		return
+	}
+
+	// The client only gets its room back, and the messages it missed, if it
+	// may still join it.
+	if s.room.Name != "" {
+		if s.room.Name != client.rejoin {
+			s.pending = nil
+			return
+		}
+		client.roomID = s.room
+		h.joinRoom(client, s.room)
+	}
+	for _, message := range s.pending {
+		client.send.push(message)
+	}
+	s.pending = nil
+}
+
+// sessionRoom returns the room of the detached session with id, if any.
+func (h *Hub) sessionRoom(id string) string {
+	result := make(chan string, 1)
+	h.sessionRooms <- sessionRoomQuery{id: id, result: result}
+	return <-result
+}
+
+func (h *Hub) detachedRoom(id string) string {
+	s, ok := h.sessions[id]
+	if !ok || s.client != nil {
+		return ""
+	}
+	return s.room.Name
+}
+
+// resumeSession returns the detached session the client asked to resume, if
+// it belongs to the same server and credentials.
+func (h *Hub) resumeSession(client *Client) (*session, bool) {
+	s, ok := h.sessions[client.resumeID]
+	if !ok || s.client != nil || time.Now().After(s.expires) {
+		return nil, false
+	}
+	if s.server != client.server.UUID || s.token != client.token || s.userEmail != client.userEmail {
+		return nil, false
+	}
+
+	h.unwatchRoom(s)
+	return s, true
+}
+
+// detachSession keeps the session of a disconnected client, along with the
+// messages it never got to write, until the grace period ends.
+func (h *Hub) detachSession(client *Client) {
+	s := client.session
+	if s == nil {
+		return
+	}
+	client.session = nil
+	s.client = nil
+
+	if client.leaving || h.closing || s.grace <= 0 {
+		delete(h.sessions, s.id)
+		return
+	}
+
+	pending, _ := client.send.drain()
+	s.pending = append(s.pending, pending...)
+	s.trim()
+	s.expires = time.Now().Add(s.grace)
+
+	if s.room.Name != "" {
+		watchers := h.detached[s.room]
+		if watchers == nil {
+			watchers = make(map[*session]struct{})
+			h.detached[s.room] = watchers
+		}
+		watchers[s] = struct{}{}
+	}
+}
+
+func (h *Hub) unwatchRoom(s *session) {
+	watchers := h.detached[s.room]
+	if watchers == nil {
+		return
+	}
+	delete(watchers, s)
+	if len(watchers) == 0 {
+		delete(h.detached, s.room)
+	}
+}
+
+// bufferForSessions keeps a room message for detached sessions in the room.
+func (h *Hub) bufferForSessions(room roomKey, message outbound) {
+	for s := range h.detached[room] {
+		s.pending = append(s.pending, message)
+		s.trim()
+	}
+}
+
+func (h *Hub) expireSessions() {
+	now := time.Now()
+	for id, s := range h.sessions {
+		if s.client == nil && now.After(s.expires) {
+			h.unwatchRoom(s)
+			delete(h.sessions, id)
+		}
+	}
+}
+
+// trim drops the oldest pending messages past the limit.
+func (s *session) trim() {
+	if len(s.pending) > s.limit {
+		s.pending = s.pending[len(s.pending)-s.limit:]
+	}
+}
@@ -0,0 +1,167 @@
+package ws
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+type closeEvent struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// refusalStatus maps the close code of a refusal to an HTTP status.
+func refusalStatus(code int) int {
+	switch code {
+	case closeUnauthorized:
+		return http.StatusUnauthorized
+	case closeOriginNotAllowed:
+		return http.StatusForbidden
+	case closeUnknownServer:
+		return http.StatusNotFound
+	case closeTooManyConnections, closeRateLimited:
+		return http.StatusTooManyRequests
+	case websocket.CloseGoingAway:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// ServeSSE streams the hub to clients that can't use websockets. It takes the
+// same parameters as ServeWs, plus an optional room to subscribe to. Messages
+// are sent to the client with ServeSSEPublish.
+func ServeSSE(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", 500)
+		return
+	}
+
+	request := newConnectRequest(r)
+	request.requireAuth = true
+	client, reason := request.accept(hub, nil)
+	if reason != nil {
+		http.Error(w, reason.reason, refusalStatus(reason.code))
+		return
+	}
+
+	if room := r.URL.Query().Get("room"); room != "" {
+		client.inbound.Lock()
+		client.subscribe(room, request.token)
+		client.inbound.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Ask proxies not to buffer the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client.streamEvents(w, flusher, r.Context().Done())
+}
+
+// ServeSSEPublish handles a message from a server-sent events client. The
+// body is what a websocket client would send in a frame, and the session id
+// from the session event authenticates the request as a bearer token.
+func ServeSSEPublish(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	result := make(chan *Client, 1)
+	hub.lookup <- clientLookup{id: mux.Vars(r)["id"], sessionID: sessionID, result: result}
+	client := <-result
+	if client == nil || client.conn != nil {
+		http.Error(w, "Connection not found.", 404)
+		return
+	}
+
+	maxSize := client.settings().MaxMessageSize
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if int64(len(body)) > maxSize {
+		http.Error(w, "Message too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	messageType := websocket.TextMessage
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/octet-stream") {
+		messageType = websocket.BinaryMessage
+	}
+
+	client.countReceived(len(body))
+	client.inbound.Lock()
+	client.refreshConfig()
+	client.handleMessage(messageType, body)
+	client.inbound.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// streamEvents is the writePump of server-sent events clients. Text messages
+// are sent as message events and binary messages, base64 encoded, as binary
+// events.
+func (c *Client) streamEvents(w io.Writer, flusher http.Flusher, done <-chan struct{}) {
+	interval := c.settings().pingInterval()
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+		c.stopWatching()
+		c.hub.unregister <- c
+		c.hub.pumps.Done()
+	}()
+
+	for {
+		select {
+		case <-c.send.ready:
+			messages, open := c.send.drain()
+			for _, message := range messages {
+				if message.binary {
+					writeEvent(w, "binary", []byte(base64.StdEncoding.EncodeToString(message.data)))
+				} else {
+					writeEvent(w, "message", message.data)
+				}
+				c.countSent(message)
+			}
+
+			if !open {
+				code, reason := c.send.closeStatus()
+				if code == 0 {
+					code = websocket.CloseNormalClosure
+				}
+				data, _ := json.Marshal(closeEvent{Code: code, Reason: reason})
+				writeEvent(w, "close", data)
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+			interval = c.resetPing(ticker, interval)
+		case <-done:
+			return
+		}
+	}
+}
+
+// writeEvent writes an event, splitting data over several data lines since
+// an event ends at the first empty line.
+func writeEvent(w io.Writer, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(w, "data: %s\n", strings.TrimSuffix(line, "\r"))
+	}
+	fmt.Fprint(w, "\n")
+}
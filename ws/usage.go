@@ -0,0 +1,101 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+// Usage is added to the hourly records this often. A flush counts toward the
+// hour it happens in.
+const usageFlushInterval = time.Minute
+
+// Connection times are kept relative to the start of the process so their
+// sums fit comfortably in milliseconds.
+var meterEpoch = time.Now()
+
+func sinceEpoch(t time.Time) int64 {
+	return t.Sub(meterEpoch).Milliseconds()
+}
+
+// usageTotals are what a server has used since the process started.
+type usageTotals struct {
+	connectionMs  int64
+	received      uint64
+	sent          uint64
+	receivedBytes uint64
+	sentBytes     uint64
+}
+
+// usageTotals reads the totals of every server. Only the hub's Run loop may
+// call it, since it owns the connection times.
+func (m *metricsRegistry) usageTotals() map[string]usageTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := sinceEpoch(time.Now())
+	totals := make(map[string]usageTotals, len(m.servers))
+	for uuid, server := range m.servers {
+		totals[uuid] = usageTotals{
+			connectionMs:  server.closedMs + server.connections.Load()*now - server.connectedMs,
+			received:      server.received.Load(),
+			sent:          server.sent.Load(),
+			receivedBytes: server.receivedBytes.Load(),
+			sentBytes:     server.sentBytes.Load(),
+		}
+	}
+	return totals
+}
+
+// usageMeter remembers the totals already recorded for each server.
+type usageMeter struct {
+	mu      sync.Mutex
+	flushed map[string]usageTotals
+}
+
+func (h *Hub) meterUsage() {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.flushUsage()
+	}
+}
+
+// flushUsage records what every server used since the last flush. Usage that
+// fails to record is retried with the next flush.
+func (h *Hub) flushUsage() {
+	h.meter.mu.Lock()
+	defer h.meter.mu.Unlock()
+
+	reply := make(chan map[string]usageTotals, 1)
+	h.usage <- reply
+	totals := <-reply
+
+	now := time.Now()
+	for uuid, total := range totals {
+		if uuid == userServer {
+			continue
+		}
+		last := h.meter.flushed[uuid]
+		usage := model.Usage{
+			ConnectionSeconds: (total.connectionMs - last.connectionMs) / 1000,
+			MessagesReceived:  int64(total.received - last.received),
+			MessagesSent:      int64(total.sent - last.sent),
+			BytesReceived:     int64(total.receivedBytes - last.receivedBytes),
+			BytesSent:         int64(total.sentBytes - last.sentBytes),
+		}
+		if usage == (model.Usage{}) {
+			continue
+		}
+		if err := api.RecordUsage(uuid, now, usage); err != nil {
+			fmt.Println("Error recording usage of", uuid+":", err)
+			continue
+		}
+
+		// Keep the milliseconds that didn't make a whole second.
+		total.connectionMs = last.connectionMs + usage.ConnectionSeconds*1000
+		h.meter.flushed[uuid] = total
+	}
+}
@@ -0,0 +1,77 @@
+package ws
+
+import (
+	"encoding/json"
+
+	"github.com/carlos-nunez/go-api-template/model"
+)
+
+const (
+	watchMessageType       = "watch"
+	unwatchMessageType     = "unwatch"
+	serverEventMessageType = "server.event"
+)
+
+// A connection can follow the event logs of this many servers at once.
+const maxWatches = 10
+
+type serverEventEnvelope struct {
+	Type  string            `json:"type"`
+	Event model.ServerEvent `json:"event"`
+}
+
+// logEvent adds an event about the client to the log of its server.
+func (c *Client) logEvent(event model.ServerEvent) {
+	event.ConnectionID = c.id
+	event.IP = c.ip
+	event.User = c.userEmail
+	api.LogServerEvent(c.server, event)
+}
+
+// watch streams the event log of a server to the client. Only connections
+// of the user server can watch, and only servers their user can use.
+func (c *Client) watch(serverUUID string) {
+	if c.server.UUID != userServer || c.userEmail == "" {
+		c.sendError("Only user connections can watch servers.")
+		return
+	}
+	if _, ok := c.watches[serverUUID]; ok {
+		return
+	}
+	if len(c.watches) >= maxWatches {
+		c.sendError("Too many servers watched.")
+		return
+	}
+	if !api.CanWatchServer(c.userEmail, serverUUID) {
+		c.sendError("Server not found.")
+		return
+	}
+
+	events, cancel := api.SubscribeServerEvents(serverUUID)
+	if c.watches == nil {
+		c.watches = make(map[string]func())
+	}
+	c.watches[serverUUID] = cancel
+	go func() {
+		for event := range events {
+			data, _ := json.Marshal(serverEventEnvelope{Type: serverEventMessageType, Event: event})
+			c.hub.direct <- directMessage{toConnection: c.id, data: data}
+		}
+	}()
+}
+
+func (c *Client) unwatch(serverUUID string) {
+	if cancel, ok := c.watches[serverUUID]; ok {
+		cancel()
+		delete(c.watches, serverUUID)
+	}
+}
+
+// stopWatching ends every event stream of the client once it disconnects.
+func (c *Client) stopWatching() {
+	c.inbound.Lock()
+	defer c.inbound.Unlock()
+	for serverUUID := range c.watches {
+		c.unwatch(serverUUID)
+	}
+}